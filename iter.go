@@ -0,0 +1,39 @@
+//go:build go1.23
+
+package gobounce
+
+import "iter"
+
+// FileEvents returns an iterator over the paths published on FileChanged, for use with range. It stops once the
+// watcher is closed or the loop breaks
+func (w *Filewatcher) FileEvents() iter.Seq[string] {
+	return receive(w.FileChanged, w.Closed)
+}
+
+// FolderEvents returns an iterator over the paths published on FolderChanged, for use with range. It stops once the
+// watcher is closed or the loop breaks
+func (w *Filewatcher) FolderEvents() iter.Seq[string] {
+	return receive(w.FolderChanged, w.Closed)
+}
+
+// AllEvents returns an iterator over the events published on Events, so it requires Options.PublishEvents. It stops
+// once the watcher is closed or the loop breaks
+func (w *Filewatcher) AllEvents() iter.Seq[Event] {
+	return receive(w.Events, w.Closed)
+}
+
+// receive yields the values from the channel until it's closed, done is closed or yield returns false
+func receive[T any](ch <-chan T, done <-chan struct{}) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for {
+			select {
+			case value, ok := <-ch:
+				if !ok || !yield(value) {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+}
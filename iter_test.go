@@ -0,0 +1,38 @@
+//go:build go1.23
+
+package gobounce
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterators(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, PublishEvents: true, ChannelBufferSize: 2}, time.Millisecond)
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	w.fire(Event{Path: path, Op: Write})
+	w.fire(Event{Path: path, Op: Create})
+
+	ops := []Op{}
+	for event := range w.AllEvents() {
+		ops = append(ops, event.Op)
+		if len(ops) == 2 {
+			break
+		}
+	}
+	assert.Equal(t, []Op{Write, Create}, ops)
+	for file := range w.FileEvents() {
+		assert.Equal(t, path, file)
+		break
+	}
+
+	go w.Close()
+	for range w.FolderEvents() { // ends once the watcher is closed
+		t.Fatal("no folder was changed")
+	}
+}
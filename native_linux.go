@@ -0,0 +1,351 @@
+//go:build linux
+
+package gobounce
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/radovskyb/watcher"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// nativeBackend watches folders and files with inotify. Like radovskyb/watcher, each folder is watched on its own, so
+// its subfolders need to be added separately
+type nativeBackend struct {
+	events       chan watcher.Event
+	errs         chan error
+	fd           int      // the inotify instance, only valid until close is closed
+	file         *os.File // wraps the fd for reading. Its Fd method mustn't be called since that makes reads blocking
+	ignoreHidden bool
+	hooks        []watcher.FilterFileHookFunc
+	mutex        sync.Mutex
+	watches      map[int]string // watched paths by watch descriptor
+	descriptors  map[string]int // watch descriptors by watched path
+	running      bool
+	started      chan struct{}
+	close        chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+	closeErr     error // returned by every call to Close
+}
+
+// removedInfo describes a file or folder which no longer exists when its event is read
+type removedInfo struct {
+	name  string
+	isDir bool
+}
+
+func (i removedInfo) Name() string       { return i.name }
+func (i removedInfo) Size() int64        { return 0 }
+func (i removedInfo) ModTime() time.Time { return time.Time{} }
+func (i removedInfo) IsDir() bool        { return i.isDir }
+func (i removedInfo) Sys() interface{}   { return nil }
+
+func (i removedInfo) Mode() os.FileMode {
+	if i.isDir {
+		return os.ModeDir
+	}
+	return 0
+}
+
+// move is the first half of a rename, waiting for its IN_MOVED_TO
+type move struct {
+	path  string
+	isDir bool
+}
+
+func newNativeBackend(ignoreHidden bool, hooks []watcher.FilterFileHookFunc) (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	return &nativeBackend{
+		events:       make(chan watcher.Event),
+		errs:         make(chan error),
+		fd:           fd,
+		file:         os.NewFile(uintptr(fd), "inotify"), // non-blocking, so reads go through the runtime poller and Close interrupts them
+		ignoreHidden: ignoreHidden,
+		hooks:        hooks,
+		watches:      make(map[int]string),
+		descriptors:  make(map[string]int),
+		started:      make(chan struct{}),
+		close:        make(chan struct{}),
+		closed:       make(chan struct{}),
+	}, nil
+}
+
+func (b *nativeBackend) Add(name string) error {
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(absName); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.isClosed() {
+		return os.ErrClosed
+	}
+	wd, err := syscall.InotifyAddWatch(b.fd, absName, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: absName, Err: err}
+	}
+	b.watches[wd] = absName
+	b.descriptors[absName] = wd
+	return nil
+}
+
+func (b *nativeBackend) Remove(name string) error {
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	wd, ok := b.descriptors[absName]
+	if !ok || b.isClosed() {
+		return nil
+	}
+	delete(b.watches, wd)
+	delete(b.descriptors, absName)
+	if _, err := syscall.InotifyRmWatch(b.fd, uint32(wd)); err != nil && err != syscall.EINVAL { // EINVAL: already removed by the kernel
+		return &os.PathError{Op: "inotify_rm_watch", Path: absName, Err: err}
+	}
+	return nil
+}
+
+// Start reads events until Close is called. The duration is ignored since changes are reported as they happen
+func (b *nativeBackend) Start(time.Duration) error {
+	b.mutex.Lock()
+	if b.isClosed() {
+		b.mutex.Unlock()
+		return os.ErrClosed
+	}
+	if b.running {
+		b.mutex.Unlock()
+		return watcher.ErrWatcherRunning
+	}
+	b.running = true
+	b.mutex.Unlock()
+	close(b.started)
+
+	defer close(b.closed)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := b.file.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			if !b.send(nil, err) {
+				return nil
+			}
+			continue
+		}
+		if !b.readEvents(buf[:n]) {
+			return nil
+		}
+	}
+}
+
+// readEvents publishes the events within the buffer. It returns false once the backend is closed
+func (b *nativeBackend) readEvents(buf []byte) bool {
+	moves := make(map[uint32]move)
+	cookies := []uint32{} // so that unmatched moves are published in order
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+		offset = nameStart + int(raw.Len)
+
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			if !b.send(nil, errors.New("inotify event queue overflowed, so some changes were missed")) {
+				return false
+			}
+			continue
+		}
+		b.mutex.Lock()
+		watched, ok := b.watches[int(raw.Wd)]
+		if ok && raw.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_IGNORED) != 0 {
+			delete(b.watches, int(raw.Wd))
+			delete(b.descriptors, watched)
+		}
+		b.mutex.Unlock()
+		if !ok {
+			continue // removed while its events were queued
+		}
+		if raw.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+			if !b.send(nil, watcher.ErrWatchedFileDeleted) { // reported like the polling watcher does
+				return false
+			}
+			continue
+		}
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			continue
+		}
+
+		path := watched
+		if name != "" {
+			path = filepath.Join(watched, name)
+		}
+		isDir := raw.Mask&syscall.IN_ISDIR != 0
+		event := watcher.Event{Path: path}
+		switch {
+		case raw.Mask&syscall.IN_MOVED_FROM != 0:
+			moves[raw.Cookie] = move{path: path, isDir: isDir}
+			cookies = append(cookies, raw.Cookie)
+			continue
+		case raw.Mask&syscall.IN_MOVED_TO != 0:
+			event.Op = watcher.Create
+			if from, ok := moves[raw.Cookie]; ok {
+				delete(moves, raw.Cookie)
+				event.Op, event.OldPath = watcher.Move, from.path
+				if filepath.Dir(from.path) == filepath.Dir(path) {
+					event.Op = watcher.Rename
+				}
+			}
+		case raw.Mask&syscall.IN_CREATE != 0:
+			event.Op = watcher.Create
+		case raw.Mask&syscall.IN_DELETE != 0:
+			event.Op = watcher.Remove
+		case raw.Mask&syscall.IN_ATTRIB != 0:
+			event.Op = watcher.Chmod
+		default:
+			event.Op = watcher.Write
+		}
+		if !b.publish(event, isDir) {
+			return false
+		}
+	}
+	for _, cookie := range cookies { // moved out of the watched folders
+		if from, ok := moves[cookie]; ok && !b.publish(watcher.Event{Op: watcher.Remove, Path: from.path}, from.isDir) {
+			return false
+		}
+	}
+	return true
+}
+
+// publish sends the event unless the filter hooks skip it. It returns false once the backend is closed
+func (b *nativeBackend) publish(event watcher.Event, isDir bool) bool {
+	info, err := os.Lstat(event.Path)
+	if err != nil {
+		info = removedInfo{name: filepath.Base(event.Path), isDir: isDir}
+	}
+	if !b.include(info, event.Path) {
+		return true
+	}
+	event.FileInfo = info
+	return b.send(&event, nil)
+}
+
+// include returns true if the file or folder isn't hidden, when hidden files are ignored, or skipped by a filter hook
+func (b *nativeBackend) include(info os.FileInfo, path string) bool {
+	if b.ignoreHidden && isHiddenFile(path) {
+		return false
+	}
+	for _, hook := range b.hooks {
+		if err := hook(info, path); err == watcher.ErrSkip {
+			return false
+		}
+	}
+	return true
+}
+
+// send publishes the event or error. It returns false if the backend was closed first
+func (b *nativeBackend) send(event *watcher.Event, err error) bool {
+	if event != nil {
+		select {
+		case b.events <- *event:
+			return true
+		case <-b.close:
+			return false
+		}
+	}
+	select {
+	case b.errs <- err:
+		return true
+	case <-b.close:
+		return false
+	}
+}
+
+func (b *nativeBackend) isClosed() bool {
+	select {
+	case <-b.close:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *nativeBackend) Close() error {
+	b.closeOnce.Do(func() {
+		b.mutex.Lock()
+		running := b.running
+		close(b.close)
+		b.mutex.Unlock()
+		b.closeErr = b.file.Close()
+		if running {
+			<-b.closed // Start closes it once its read is interrupted
+		} else {
+			close(b.closed)
+		}
+	})
+	return b.closeErr
+}
+
+func (b *nativeBackend) Wait() {
+	<-b.started
+}
+
+// WatchedFiles lists the watched files and folders along with the contents of the watched folders
+func (b *nativeBackend) WatchedFiles() map[string]os.FileInfo {
+	b.mutex.Lock()
+	watched := make([]string, 0, len(b.descriptors))
+	for path := range b.descriptors {
+		watched = append(watched, path)
+	}
+	b.mutex.Unlock()
+
+	files := make(map[string]os.FileInfo)
+	for _, path := range watched {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files[path] = info
+		if !info.IsDir() {
+			continue
+		}
+		entries, _ := os.ReadDir(path)
+		for _, entry := range entries {
+			entryPath := filepath.Join(path, entry.Name())
+			if entryInfo, err := entry.Info(); err == nil && b.include(entryInfo, entryPath) {
+				files[entryPath] = entryInfo
+			}
+		}
+	}
+	return files
+}
+
+func (b *nativeBackend) Events() <-chan watcher.Event {
+	return b.events
+}
+
+func (b *nativeBackend) Errors() <-chan error {
+	return b.errs
+}
+
+func (b *nativeBackend) Closed() <-chan struct{} {
+	return b.closed
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package gobounce
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNativeBackend(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "sub"), 0755))
+	path := filepath.Join(root, "sub", "file")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+
+	w, err := New(Options{RootFolders: []string{root}, Backend: BackendNative, PublishEvents: true, ExcludePatterns: []string{"*.tmp"}}, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Contains(t, w.WatchedFiles(), path)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sub", "skipped.tmp"), nil, 0644))
+	require.NoError(t, os.WriteFile(path, []byte("changed"), 0644))
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, filepath.Join(root, "sub"), <-w.FolderChanged)
+	assert.ElementsMatch(t, []Event{
+		{Path: path, Op: Write},
+		{Path: filepath.Join(root, "sub"), Op: Write, IsDir: true},
+	}, withoutStat(<-w.Events, <-w.Events))
+
+	renamed := filepath.Join(root, "sub", "renamed")
+	require.NoError(t, os.Rename(path, renamed))
+	assert.Equal(t, renamed, <-w.FileChanged)
+	<-w.FolderChanged
+	assert.ElementsMatch(t, []Event{
+		{Path: renamed, Op: Rename, OldPath: path},
+		{Path: filepath.Join(root, "sub"), Op: Write, IsDir: true},
+	}, withoutStat(<-w.Events, <-w.Events))
+	assert.Empty(t, w.FileChanged)
+}
+
+func TestNativeBackendClose(t *testing.T) {
+	b, err := newNativeBackend(false, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.Add(t.TempDir()))
+	b.Close() // before Start
+	<-b.Closed()
+	assert.Error(t, b.Start(time.Millisecond))
+	assert.ErrorIs(t, b.Add(t.TempDir()), os.ErrClosed)
+
+	b, err = newNativeBackend(false, nil)
+	require.NoError(t, err)
+	go b.Start(time.Millisecond)
+	b.Wait()
+	b.Close()
+	<-b.Closed()
+}
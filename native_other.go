@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gobounce
+
+import (
+	"errors"
+
+	"github.com/radovskyb/watcher"
+)
+
+func newNativeBackend(ignoreHidden bool, hooks []watcher.FilterFileHookFunc) (Watcher, error) {
+	return nil, errors.New("the native backend is only supported on Linux")
+}
@@ -2,14 +2,22 @@
 package gobounce
 
 import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/radovskyb/watcher"
@@ -18,25 +26,523 @@ import (
 type Filewatcher struct {
 	FileChanged   chan string
 	FolderChanged chan string
+	FileRemoved   chan string              // only used with Options.NotifyRemoved
+	FolderRemoved chan string              // only used with Options.NotifyRemoved
+	Events        chan Event               // richer version of FileChanged and FolderChanged which includes the operation type. Only used with Options.PublishEvents
+	BatchChanged  chan []string            // changed and removed files which settled within the same Options.BatchWindow
+	BatchByFolder chan map[string][]string // the same batches grouped by the folder containing each file. Only used with Options.GroupByFolder, instead of BatchChanged
+	AnyChanged    chan string              // every path published on FileChanged or FolderChanged. Only used with Options.NotifyAny
 	Error         chan error
+	Ready         chan struct{} // closed once Start has finished setting up, after which every change is caught
+	Idle          chan struct{} // signalled once no events have been received for Options.IdleTimeout
 	Closed        chan struct{}
 
-	watcher          *watcher.Watcher
+	watcher          atomic.Value // Watcher, replaced by SetPollDuration
+	watcherMutex     sync.Mutex   // held while adding to, removing from or replacing the underlying watcher
+	filter           atomic.Value // *fileFilter, replaced by refreshFilter
 	options          Options
 	pollDuration     time.Duration
-	fileDebounce     map[string]*time.Timer
-	folderDebounce   map[string]*time.Timer
+	defaultDebounce  bool            // the debounceDuration follows the pollDuration since Options.DebounceDuration wasn't set
+	folders          map[string]bool // absolute paths of the folders added to the underlying watcher
+	initialFolders   []string        // sorted absolute paths of the folders New added to the underlying watcher
+	folderPatterns   []*regexp.Regexp
+	rootOptions      map[string]*rootSettings // options for each root folder, keyed by absolute path. Only used with NewMulti
+	watchignore      map[string][]string      // patterns from the .watchignore file of each root folder, keyed by absolute path
+	skipped          map[string]string        // reasons the folders found while listing the roots weren't watched, keyed by absolute path
+	expandedParents  map[string]bool          // absolute paths of the RootFolders watched for new children with Options.ExpandChildrenAsRoots
+	stats            WatcherStats
+	running          bool         // the underlying watcher's poll loop has been started and hasn't returned
+	lastPoll         atomic.Value // time.Time the underlying watcher was last seen polling, stored without the mutex by the filter hook
+	onFileChanged    func(path string)
+	onFolderChanged  func(path string)
+	paused           bool
+	muted            map[string]bool  // absolute paths muted with Mute
+	timers           timerHeap        // pending debounce entries ordered by deadline, all serviced by the runTimers goroutine
+	timer            Timer            // fires at the earliest deadline. Created along with runTimers for the first entry
+	settling         []*debounceEntry // entries whose timers have fired, waiting for a settler
+	settlers         int              // settleQueued goroutines running, up to Options.MaxConcurrency
+	idleTimer        Timer            // fires once Options.IdleTimeout passes without events. Created along with waitIdle for the first event
+	lastEvent        time.Time        // when the most recent event was received. Only used with Options.IdleTimeout
+	held             []Event          // events waiting for Resume
+	pausedChanges    bool
+	batch            []string
+	batchPaths       map[string]bool
+	fileDebounce     map[string]*debounceEntry
+	folderDebounce   map[string]*debounceEntry
 	debounceDuration time.Duration
+	clock            Clock
+	logger           Logger                       // Options.Logger, which is fixed once the watcher is created so it can be used without the mutex
+	lastNotified     map[string]notified          // most recent notification for each path within the Options.DedupeWindow
+	seq              uint64                       // Seq of the most recent notification
+	addErrors        []error                      // folders and root files New couldn't add with Options.BestEffort, published once started
+	tokens           float64                      // notifications which can be sent right away under Options.MaxNotificationsPerSecond
+	tokensAt         time.Time                    // when the tokens were last refilled
+	contentHashes    map[string][sha256.Size]byte // content of the most recently notified files. Only used with Options.SkipUnchangedContent
+	hashOrder        []string                     // paths in contentHashes from oldest to newest, so the oldest can be evicted
 	mutex            sync.Mutex
+	wg               sync.WaitGroup // tracks the listen goroutine and all goroutines it spawns
+	done             chan struct{}  // closed once Close is called to stop all pending debounce goroutines
+	finished         chan struct{}  // closed once Close has finished waiting for all goroutines to exit
+	armed            chan struct{}  // closed once Start may begin watching, straight away unless Options.StartPaused is set
+	armOnce          sync.Once
+	readyOnce        sync.Once
+	closeOnce        sync.Once
+	closeErr         error // the first error from closing the underlying watcher. Guarded by the watcherMutex
+}
+
+// Op describes the type of filesystem operation that triggered an Event
+type Op uint32
+
+const (
+	Create = Op(watcher.Create)
+	Write  = Op(watcher.Write)
+	Remove = Op(watcher.Remove)
+	Rename = Op(watcher.Rename)
+	Chmod  = Op(watcher.Chmod)
+	Move   = Op(watcher.Move)
+)
+
+func (o Op) String() string {
+	return watcher.Op(o).String()
+}
+
+// Event is published on the Events channel each time a debounced file or folder notification fires
+type Event struct {
+	Path    string
+	Op      Op
+	IsDir   bool
+	OldPath string    // only populated for Rename and Move events
+	Size    int64     // size when the notification fired. 0 for removals
+	ModTime time.Time // modification time when the notification fired. Zero for removals
+	Root    string    // absolute path of the root folder or root file the path belongs to, as returned by RootFor
+
+	// Seq increases with every notification published by the watcher, giving the settled changes a total order. The
+	// notifications are sent concurrently, so one with a lower Seq can still be received after one with a higher Seq
+	Seq uint64
+}
+
+// notified records when a path was last notified and for which operation, used to enforce Options.DedupeWindow
+type notified struct {
+	op Op
+	at time.Time
+}
+
+type debounceEntry struct {
+	event       Event
+	debounceMap map[string]*debounceEntry // the map holding the entry, which it's removed from once its timer fires
+	deadline    time.Time                 // when the debounce timer fires
+	index       int                       // position within the Filewatcher's timers, or -1 once removed from them
+	first       time.Time                 // when the first event arrived, used to enforce Options.MaxDebounceDuration
+	fired       bool                      // already notified on the leading edge
+	pending     bool                      // received further events after firing on the leading edge
+	created     bool                      // the first event was a Create, used with Options.IgnoreTransientFiles
+
+	// causes are the files and subfolders which changed within a folder, mapped to whether they were created within
+	// the window. Only used with Options.IgnoreTransientFiles
+	causes map[string]bool
+}
+
+// SkipInfo describes a folder which was found while listing the root folders but isn't watched
+type SkipInfo struct {
+	Path   string // absolute path
+	Reason string // e.g. "hidden folder", "excluded folder" or "deeper than max depth"
+}
+
+// WatchError is published on the Error channel with the path and operation which caused the error, when known
+type WatchError struct {
+	Op   string // e.g. "stat" or "open". Empty when unknown
+	Path string // empty when unknown
+	Err  error
+}
+
+func (e *WatchError) Error() string {
+	switch {
+	case e.Path == "":
+		return e.Err.Error()
+	case e.Op == "":
+		return e.Path + ": " + e.Err.Error()
+	default:
+		return e.Op + " " + e.Path + ": " + e.Err.Error()
+	}
+}
+
+func (e *WatchError) Unwrap() error {
+	return e.Err
+}
+
+// ErrRootFolderDeleted is published on the Error channel, wrapped in a WatchError with the root's path, when a root
+// folder is deleted. The other roots keep being watched
+var ErrRootFolderDeleted = errors.New("root folder deleted")
+
+// ErrWalkTimeout is returned by New, or published on the Error channel with Options.BestEffort, for each root folder
+// whose subfolders couldn't be listed within the Options.WalkTimeout
+var ErrWalkTimeout = errors.New("timed out listing folders")
+
+// DebounceMode controls when a notification fires relative to the debounce window
+type DebounceMode int
+
+const (
+	TrailingEdge DebounceMode = iota // notify once no further change has been seen for the debounce duration
+	LeadingEdge                      // notify on the first change and suppress the rest until the window settles
+	Both                             // notify on the first change and again once the window settles if further changes arrived
+)
+
+// WatcherStats holds counters describing the current state and history of a Filewatcher
+type WatcherStats struct {
+	WatchedFolders      int    // number of folders added to the underlying watcher
+	PendingFileTimers   int    // number of file debounce timers which haven't fired yet
+	PendingFolderTimers int    // number of folder debounce timers which haven't fired yet
+	EventsProcessed     uint64 // total events received from the underlying watcher
+	Notifications       uint64 // total notifications published after debouncing
+	Dropped             uint64 // total notifications dropped because the path no longer existed, or its content was unchanged with Options.SkipUnchangedContent
+	DroppedFull         uint64 // total path channel sends dropped because the channel was full. Only used with Options.DropOnFull
+	DroppedEvents       uint64 // total Events channel sends dropped because the channel was full. Only used with Options.DropOnFull
+	DroppedErrors       uint64 // total errors dropped because the Error channel was full. Only used with Options.DropErrors
+	Deduplicated        uint64 // total notifications suppressed because they repeated one within the Options.DedupeWindow
+	Throttled           uint64 // total notifications dropped for exceeding Options.MaxNotificationsPerSecond. Only used with Options.DropThrottled
+}
+
+// Backend selects how the underlying watcher detects filesystem changes
+type Backend int
+
+const (
+	BackendPoll   Backend = iota // poll the watched folders every pollDuration, which works on every platform
+	BackendNative                // rely on the operating system's change notifications. Only supported on Linux, using inotify
+)
+
+// Watcher is the underlying watcher which detects filesystem changes and reports them as radovskyb/watcher events. Each
+// folder is added on its own and only its direct contents are watched. Implementations can be plugged in with
+// Options.NewWatcher. All methods must be safe to call concurrently, since folders are added and removed as events
+// arrive while WatchedFiles may be called at any time. WatchedFiles must return a copy which isn't changed afterwards
+type Watcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Start(pollDuration time.Duration) error // blocks until Close is called
+	Close() error
+	Wait()                                // blocks until Start has been called
+	WatchedFiles() map[string]os.FileInfo // the watched files and folders along with the contents of the watched folders
+	Events() <-chan watcher.Event
+	Errors() <-chan error
+	Closed() <-chan struct{} // closed once Close has been called
+}
+
+// pollBackend adapts radovskyb/watcher's polling watcher to the Watcher interface
+type pollBackend struct {
+	*watcher.Watcher
+}
+
+func (b pollBackend) Events() <-chan watcher.Event {
+	return b.Event
+}
+
+func (b pollBackend) Errors() <-chan error {
+	return b.Error
+}
+
+func (b pollBackend) Closed() <-chan struct{} {
+	return b.Watcher.Closed
+}
+
+// Close stops polling. radovskyb/watcher doesn't report errors on Close, so it always returns nil
+func (b pollBackend) Close() error {
+	b.Watcher.Close()
+	return nil
+}
+
+// RootFolder is a folder to watch along with whether its subfolders should be watched too
+type RootFolder struct {
+	Path      string
+	Recursive bool
+}
+
+// RootConfig is a root folder along with the options which apply to it when watching several roots with NewMulti
+type RootConfig struct {
+	Path    string
+	Options Options
+}
+
+// rootSettings are the prepared options for a root folder added with NewMulti
+type rootSettings struct {
+	options        Options
+	folderPatterns []*regexp.Regexp
+}
+
+// fileFilter is a snapshot of the options which the filter hook applies to every file on every poll, so that it
+// doesn't need the mutex. It's replaced by refreshFilter whenever the options or the root folders change
+type fileFilter struct {
+	options     *Options
+	roots       map[string]bool     // absolute paths of the root folders
+	prefixes    []string            // absolute paths of the root folders with a trailing separator. Only used with NewMulti
+	rootOptions map[string]*Options // options for each NewMulti root folder, keyed by its prefix
+}
+
+// optionsFor returns the options which apply to the absolute path, just like Filewatcher.optionsFor
+func (f *fileFilter) optionsFor(path string) *Options {
+	closest := ""
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > len(closest) { // the longest root containing the path is the closest
+			closest = prefix
+		}
+	}
+	if options := f.rootOptions[closest]; options != nil {
+		return options
+	}
+	return f.options
+}
+
+// skips returns true if the file shouldn't be listed by the underlying watcher
+func (f *fileFilter) skips(path string, info os.FileInfo) bool {
+	options := f.optionsFor(path)
+	if matchesPattern(options.ExcludePatterns, path, f.options.CaseInsensitive) || !hasWatchedExtension(options, path) {
+		return true
+	}
+	return f.options.Filter != nil && !f.options.Filter(path, info)
 }
 
 type Options struct {
 	RootFolders      []string
-	FolderExclusions []string
-	IncludeHidden    bool
+	Roots            []RootFolder // watched in addition to RootFolders, but with recursion controlled per root instead of by ExcludeSubdirs
+	RootFiles        []string     // individual files to watch without watching the rest of their folder
+	ExactFolders     []string     // folders watched as roots of their own without listing their subfolders, which avoids walking an enormous tree when the folders of interest are known
+	FolderExclusions []string     // folder names or paths excluded wherever they appear, e.g. "vendor" or "src/gen". Starting with "./" only matches directly below a root folder, e.g. "./build"
+	IncludeHidden    bool         // shortcut for setting both IncludeHiddenFiles and IncludeHiddenFolders
 	ExcludeSubdirs   bool
 	FollowNewFolders bool
-	MaxConcurrency   int
+	MaxConcurrency   int // how many debounce timers which have fired are settled at the same time. Defaults to GOMAXPROCS
+
+	// FollowNewFoldersPattern limits the folders followed with FollowNewFolders to those whose name matches this
+	// filepath.Match pattern, e.g. "session*". It applies to every new folder, including those created within a
+	// followed folder, but not to the folders found by New, AddFolder or Restart. Empty means all new folders are followed
+	FollowNewFoldersPattern string
+
+	// BeforeAddFolder is called with the absolute path of each new folder which FollowNewFolders is about to add, and
+	// the folder is skipped when it returns false. This allows for arbitrary rules, or setup such as registering the
+	// folder elsewhere. It runs synchronously while events are delivered, so it must be fast and must not call
+	// AddFolder, RemoveFolder, Restart or SetIncludeHidden, which would block until it returns. nil adds every folder
+	BeforeAddFolder func(path string) bool
+
+	// Backend selects how changes are detected and defaults to BackendPoll. With BackendNative, changes are reported
+	// as they happen rather than on the next poll, so the pollDuration only determines the default DebounceDuration.
+	// The native backend only sees changes to the watched folders themselves, so a folder isn't notified when the
+	// modification time of a subfolder changes
+	Backend Backend
+
+	// NewWatcher creates the underlying watcher instead of the Backend. It must return a pointer or another comparable
+	// value of the same type each time it's called, since SetPollDuration creates a replacement. Hidden files and the
+	// file patterns are still filtered before debouncing, but unlike the built in backends the watcher isn't told to
+	// skip them
+	NewWatcher func() (Watcher, error)
+
+	IncludeHiddenFiles   bool // notify for files starting with a dot
+	IncludeHiddenFolders bool // watch folders starting with a dot
+
+	// ChannelBufferSize sets the buffer size of the notification and Error channels and defaults to MaxConcurrency.
+	// Larger buffers let the watcher keep going through short consumer hiccups at the cost of holding more pending
+	// notifications in memory
+	ChannelBufferSize int
+
+	// PublishEvents also publishes each notification on the Events channel. Events must then be drained along with
+	// the path channels, otherwise notifications wait for room in its buffer
+	PublishEvents bool
+
+	// NotifyRemoved publishes removed files and folders on FileRemoved and FolderRemoved. Those channels must then be
+	// drained too, otherwise notifications wait for room in their buffers. Without it, removals are only published
+	// on Events and BatchChanged
+	NotifyRemoved bool
+
+	// NotifyAny also publishes every path sent on FileChanged or FolderChanged on the AnyChanged channel, for consumers
+	// which treat files and folders alike. AnyChanged must then be drained too
+	NotifyAny bool
+
+	DebounceDuration time.Duration // defaults to 2x the pollDuration. Must be greater than the pollDuration
+	MaxDepth         int           // maximum number of folder levels below each root folder to watch. 0 means unlimited
+	RelativePaths    bool          // publish paths relative to their root folder. Paths outside the root folders, such as RootFiles, stay absolute
+	ForwardSlashes   bool          // publish paths with forward slashes as the separator, even on Windows
+	CaseInsensitive  bool          // match folder exclusions and file patterns without regard to case
+	NotifyExisting   bool          // publish all existing files on FileChanged when the watcher is started, before polling for changes. With FolderEventsOnly or CollapseToRoot, their folders are published on FolderChanged instead
+	FollowSymlinks   bool          // watch symlinked folders. Symlinks pointing back up the tree are only watched once
+	CoalesceFolders  bool          // only notify for the most specific folder when a folder and its subfolders change together
+	FolderEventsOnly bool          // only notify on FolderChanged, for the folder containing each changed file. This includes the folders of RootFiles
+	CollapseToRoot   bool          // only notify on FolderChanged, once per debounce window, for the root folder containing the changes. Can't be combined with FileEventsOnly
+	FileEventsOnly   bool          // only notify for files, so FolderChanged and FolderRemoved don't need to be drained. Can't be combined with FolderEventsOnly
+	DropOnFull       bool          // drop notifications when a channel's buffer is full rather than waiting for the consumer
+	DropErrors       bool          // drop errors, logging them to the Logger, when the Error channel's buffer is full rather than waiting for the consumer, so a missing Error reader doesn't stop events from being processed
+	BatchWindow      time.Duration // when set, files which settle within this window of each other are also published together on BatchChanged
+	GroupByFolder    bool          // publish each batch on BatchByFolder, as the files which changed within each folder, instead of on BatchChanged. Requires BatchWindow
+	DebounceMode     DebounceMode  // when notifications fire within the debounce window. Defaults to TrailingEdge
+	IgnoreChmod      bool          // ignore permission and other attribute changes, which are otherwise published with the Chmod operation
+	CreateOnly       bool          // only notify for files and folders which appear through Create, Move or Rename, ignoring later writes, attribute changes and removals
+	SplitRenames     bool          // publish a Rename or Move as a Remove of the old path followed by a Create of the new one, so the old path reaches FileRemoved or FolderRemoved with NotifyRemoved
+	IgnoreEditorTemp bool          // ignore editor swap, backup and lock files such as file.txt~, .file.txt.swp and 4913. Saving by renaming one over the real file publishes a Write
+
+	// DebounceByPattern overrides the DebounceDuration for files whose base name matches a filepath.Match pattern,
+	// e.g. {"*.bin": 2 * time.Second}. When several patterns match, the longest duration wins. Each duration must be
+	// greater than the pollDuration
+	DebounceByPattern map[string]time.Duration
+
+	// MaxDebounceDuration forces a notification once this long has passed since the first event, even if further
+	// events keep resetting the debounce timer. This guarantees progress for files which change continuously. 0 means
+	// no limit. Must not be less than the DebounceDuration
+	MaxDebounceDuration time.Duration
+
+	// IgnoreTransientFiles drops the notifications for a file which is created and deleted again within the debounce
+	// window, along with the notification for its folder when nothing else in the folder changed. Only applies to
+	// notifications on the trailing edge of the window
+	IgnoreTransientFiles bool
+
+	// BestEffort keeps New going when a root folder, subfolder or root file can't be added, e.g. due to missing
+	// permissions, rather than failing altogether. Each failure is published on the Error channel as a WatchError once
+	// the watcher is started
+	BestEffort bool
+
+	// MaxNotificationsPerSecond limits how many debounced notifications are published each second, allowing bursts of
+	// up to that many. Notifications beyond the limit wait their turn unless DropThrottled is set, in which case they're
+	// dropped and counted in WatcherStats.Throttled. 0 means no limit
+	MaxNotificationsPerSecond int
+	DropThrottled             bool
+
+	// SkipUnchangedContent drops Write and Chmod notifications for files whose content hashes the same as when they
+	// were last notified, such as when a formatter rewrites a file without changing it. The hashes of up to
+	// contentHashLimit files are kept, so the first change to a file, or to one which has since been evicted, is
+	// always notified
+	SkipUnchangedContent bool
+
+	// WalkTimeout limits how long New spends listing the subfolders of the root folders, which can hang on an
+	// unresponsive network mount. New fails with ErrWalkTimeout if the limit is reached, unless BestEffort is set, in
+	// which case the roots listed in time are watched and ErrWalkTimeout is published for the others. 0 means no limit
+	WalkTimeout time.Duration
+
+	// AddRetries retries adding a folder to the underlying watcher up to this many times when it fails, such as when
+	// antivirus software briefly locks a new folder. The first retry waits AddRetryDelay, defaulting to 100ms, and
+	// each one after waits twice as long as the last. Folders which no longer exist aren't retried. When a followed
+	// folder still can't be added, a WatchError is published on the Error channel
+	AddRetries    int
+	AddRetryDelay time.Duration
+
+	// StabilityDelay holds back a file notification after the debounce timer fires until the file's size and
+	// modification time have stayed the same for this long, checking again each time they change. This ensures large
+	// files which are still being copied are only published once complete. 0 disables the check
+	StabilityDelay time.Duration
+
+	// DedupeWindow suppresses a notification which repeats the path and operation of one published less than this long
+	// ago. Unlike debouncing, which waits for changes to settle, this guards against a path which settles and then
+	// changes again straight away. 0 disables deduplication
+	DedupeWindow time.Duration
+
+	// IdleTimeout signals on the Idle channel once no events at all have been received for this long, e.g. so that a
+	// full build can run once everything has settled. It fires once, and is rearmed by the next event. Events are
+	// counted as they arrive, before debouncing, so it should be longer than the DebounceDuration for the pending
+	// notifications to have been published by then. 0 disables the signal
+	IdleTimeout time.Duration
+
+	// BufferWhilePaused keeps the events received while paused and debounces them on Resume instead of discarding
+	// them. NotifyOnResume publishes each root folder on FolderChanged when Resume is called after events were discarded
+	BufferWhilePaused bool
+	NotifyOnResume    bool
+
+	// StartPaused makes Start and StartContext wait until Arm is called before they begin watching, so the watcher
+	// can be set up ahead of time without polling. The folders are still listed by New, so changes made before Arm
+	// are reported once watching begins. With NotifyExisting, the existing files are published when Arm is called
+	StartPaused bool
+
+	// IncludePatterns limits file notifications to files whose base name matches at least one filepath.Match
+	// pattern. Empty means all files are included. Hidden files are filtered out before the patterns are checked,
+	// so a pattern like ".*" only matches when IncludeHidden or IncludeHiddenFiles is also set
+	IncludePatterns []string
+
+	// ExcludePatterns suppresses notifications for files whose base name matches any filepath.Match pattern, no
+	// matter which folder they are in. Exclusions take precedence over IncludePatterns. Since creating or removing an
+	// excluded file changes its folder's modification time, the folders then only notify for changes to the files and
+	// subfolders within them, so touching a folder by itself isn't reported
+	ExcludePatterns []string
+
+	// Watchignore applies the patterns in a .watchignore file within each root folder. Each line holds a
+	// filepath.Match pattern, while blank lines and lines starting with # are skipped. Patterns without a slash match
+	// the name of any file or folder below the root, e.g. "node_modules", while those with a slash match the path
+	// relative to the root, e.g. "build/*.o". Matching folders aren't watched and nothing below them is notified. The
+	// file is reloaded whenever it changes, but folders which were already being watched stay watched until Restart
+	Watchignore bool
+
+	// ExpandChildrenAsRoots watches each subfolder of the RootFolders as a root folder of its own, e.g. each repo
+	// within a projects folder, so that per root settings such as Watchignore apply to each of them separately. Files
+	// directly within the RootFolders aren't watched. With FollowNewFolders, subfolders created later are added as
+	// roots too, as if by AddFolder. Otherwise they're only picked up by AddFolder. Doesn't apply to NewMulti
+	ExpandChildrenAsRoots bool
+
+	// WatchExtensions limits the watched files to those with one of these extensions, e.g. ".json". Other files are
+	// skipped while listing each folder, so unlike IncludePatterns the underlying watcher doesn't have to keep track of
+	// them. This saves a lot of memory when a folder holds many files which aren't of interest. Empty means all files
+	WatchExtensions []string
+
+	// ExcludePrefixes are folders, given as absolute or relative paths, which are excluded along with everything below
+	// them. Unlike FolderExclusions, they only match at that exact location
+	ExcludePrefixes []string
+
+	// FolderExclusionPatterns are regular expressions matched against the absolute path of each folder. Unlike
+	// FolderExclusions, which match any folder name within the path, these allow for precise exclusions
+	FolderExclusionPatterns []string
+
+	// Filter decides whether a file or folder is watched and notified, for rules which the other options can't express.
+	// It's called for every folder while walking the root folders, for every file each time a folder is polled and for
+	// every event, so it must be fast. It may be called concurrently and while the watcher holds its lock, so it
+	// must be safe for concurrent use and must not call the Filewatcher's methods. nil means no filtering
+	Filter func(path string, info os.FileInfo) bool
+
+	// Clock creates the timers used for debouncing and batching. Defaults to the system clock, but can be replaced to
+	// control time in tests
+	Clock Clock
+
+	// Logger receives diagnostic messages about which folders are watched and how events are debounced. Defaults
+	// to discarding all messages
+	Logger Logger
+}
+
+// Clock is the source of time used by the watcher
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the subset of time.Timer used by the watcher
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Reset(d time.Duration) bool {
+	return t.timer.Reset(d)
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// editorTempPatterns match the temporary files editors create while saving. Vim writes 4913 to test whether it can create
+// files in the folder
+var editorTempPatterns = []string{"*~", ".*.swp", ".*.swo", ".*.swx", ".*.swpx", "4913", ".#*", "#*#", "*.crswap"}
+
+// Logger is the interface used by the watcher to report diagnostic messages
+type Logger interface {
+	Debugf(format string, args ...interface{})
 }
 
 // New creates a debounced file watcher. It will watch for changes to the filesystem every `pollDuration` duration
@@ -57,207 +563,2966 @@ type Options struct {
 // (4 seconds)     poll for changes - no new changes found
 //                 debounce timer finishes for folder1/file2. FileChanged channel publishes the filename
 //                 debounce timer finishes for folder1. FileChanged channel publishes the folder name
+//
+// The debounceDuration can be overridden with Options.DebounceDuration, but it must be greater than the pollDuration.
 func New(options Options, pollDuration time.Duration) (*Filewatcher, error) {
+	return newFilewatcher(options, pollDuration, nil)
+}
+
+// NewMulti creates a debounced file watcher for several root folders which each have their own options. The
+// ExcludeSubdirs, FollowNewFolders, FollowNewFoldersPattern, MaxDepth, FolderExclusions, FolderExclusionPatterns, ExcludePrefixes,
+// IncludePatterns, ExcludePatterns and WatchExtensions options only apply to the folders and files below their root. All other options,
+// such as the debounce, hidden file and channel settings, are shared and taken from the first RootConfig. The
+// RootFolders, Roots, RootFiles and ExactFolders within each RootConfig's options are ignored. UpdateOptions only replaces the shared
+// options
+func NewMulti(roots []RootConfig, pollDuration time.Duration) (*Filewatcher, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("at least one root folder is required")
+	}
+	options := roots[0].Options.clone()
+	options.RootFolders, options.Roots, options.RootFiles, options.ExactFolders = nil, make([]RootFolder, 0, len(roots)), nil, nil
+	rootOptions := make(map[string]*rootSettings, len(roots))
+	for _, root := range roots {
+		absRoot, err := filepath.Abs(root.Path)
+		if err != nil {
+			return nil, err
+		}
+		if rootOptions[absRoot] != nil {
+			return nil, fmt.Errorf("root folder %s is configured more than once", root.Path)
+		}
+		settings := &rootSettings{options: root.Options.clone()}
+		settings.options.CaseInsensitive = options.CaseInsensitive // patterns are always matched using the shared setting
+		if settings.folderPatterns, err = prepareOptions(&settings.options); err != nil {
+			return nil, fmt.Errorf("invalid options for root folder %s: %w", root.Path, err)
+		}
+		rootOptions[absRoot] = settings
+		options.Roots = append(options.Roots, RootFolder{Path: root.Path, Recursive: !root.Options.ExcludeSubdirs})
+	}
+	return newFilewatcher(options, pollDuration, rootOptions)
+}
+
+func newFilewatcher(options Options, pollDuration time.Duration, rootOptions map[string]*rootSettings) (*Filewatcher, error) {
 	if options.MaxConcurrency == 0 { // no concurrency set, so use GOMAXPROCS
 		options.MaxConcurrency = runtime.GOMAXPROCS(0)
 	}
+	if options.ChannelBufferSize == 0 {
+		options.ChannelBufferSize = options.MaxConcurrency
+	}
+	defaultDebounce := options.DebounceDuration == 0
+	if defaultDebounce {
+		options.DebounceDuration = 2 * pollDuration
+	}
+	if options.DebounceDuration <= pollDuration { // the debounceDuration must always be > pollDuration for debounce to work
+		return nil, fmt.Errorf("debounce duration %s must be greater than poll duration %s", options.DebounceDuration, pollDuration)
+	}
+	if options.MaxDebounceDuration != 0 && options.MaxDebounceDuration < options.DebounceDuration {
+		return nil, fmt.Errorf("max debounce duration %s must not be less than debounce duration %s", options.MaxDebounceDuration, options.DebounceDuration)
+	}
+	if err := validateDebounceByPattern(options.DebounceByPattern, pollDuration); err != nil {
+		return nil, err
+	}
 	w := &Filewatcher{
-		FileChanged:      make(chan string, options.MaxConcurrency),
-		FolderChanged:    make(chan string, options.MaxConcurrency),
-		Error:            make(chan error),
-		watcher:          watcher.New(),
+		FileChanged:      make(chan string, options.ChannelBufferSize),
+		FolderChanged:    make(chan string, options.ChannelBufferSize),
+		FileRemoved:      make(chan string, options.ChannelBufferSize),
+		FolderRemoved:    make(chan string, options.ChannelBufferSize),
+		Events:           make(chan Event, options.ChannelBufferSize),
+		BatchChanged:     make(chan []string, options.ChannelBufferSize),
+		BatchByFolder:    make(chan map[string][]string, options.ChannelBufferSize),
+		AnyChanged:       make(chan string, options.ChannelBufferSize),
+		Error:            make(chan error, options.ChannelBufferSize),
+		Ready:            make(chan struct{}),
+		Idle:             make(chan struct{}, 1),
+		Closed:           make(chan struct{}),
+		armed:            make(chan struct{}),
 		options:          options,
 		pollDuration:     pollDuration,
-		debounceDuration: 2 * pollDuration, // note that the debounceDuration must always be > pollDuration for debounce to work
-		fileDebounce:     make(map[string]*time.Timer),
-		folderDebounce:   make(map[string]*time.Timer),
+		defaultDebounce:  defaultDebounce,
+		debounceDuration: options.DebounceDuration,
+		clock:            options.Clock,
+		logger:           options.Logger,
+		rootOptions:      rootOptions,
+		folders:          make(map[string]bool),
+		fileDebounce:     make(map[string]*debounceEntry),
+		folderDebounce:   make(map[string]*debounceEntry),
+		watchignore:      make(map[string][]string),
+		contentHashes:    make(map[string][sha256.Size]byte),
+		lastNotified:     make(map[string]notified),
+		done:             make(chan struct{}),
+		finished:         make(chan struct{}),
 	}
-	w.Closed = w.watcher.Closed
-	if !w.options.IncludeHidden {
-		w.watcher.IgnoreHiddenFiles(true)
+	if w.clock == nil {
+		w.clock = systemClock{}
 	}
-	w.options.FolderExclusions = prepareFolders(w.options.FolderExclusions)
-
-	watchFolders, err := w.getWatchFolders()
+	if err := w.setup(); err != nil {
+		return nil, err
+	}
+	w.refreshFilter()
+	if !w.options.StartPaused {
+		w.Arm()
+	}
+	underlying, err := w.newWatcher()
 	if err != nil {
-		return nil, fmt.Errorf("error determining watch folders: %w", err)
+		return nil, err
 	}
-	for _, folder := range watchFolders {
-		if err := w.watcher.Add(folder); err != nil {
-			return nil, fmt.Errorf("error adding watch folder: %w", err)
-		}
+	w.watcher.Store(underlying)
+	if err := w.addRoots(); err != nil {
+		underlying.Close()
+		return nil, err
 	}
+	w.initialFolders = make([]string, 0, len(w.folders))
+	for folder := range w.folders {
+		w.initialFolders = append(w.initialFolders, folder)
+	}
+	sort.Strings(w.initialFolders)
 	return w, nil
 }
 
-func (w *Filewatcher) getWatchFolders() ([]string, error) {
-	if w.options.ExcludeSubdirs {
-		return w.options.RootFolders, nil
+// addRoots adds the root folders, along with their subfolders, and the root files to the underlying watcher
+func (w *Filewatcher) addRoots() error {
+	seen := make(map[string]bool)
+	for _, walk := range w.walkRoots() {
+		root, folders, err := walk.root, walk.folders, walk.err
+		if err != nil {
+			if !w.options.BestEffort {
+				return fmt.Errorf("error determining watch folders: %w", err)
+			}
+			w.addErrors = append(w.addErrors, &WatchError{Op: "add", Path: root.Path, Err: err})
+			continue
+		}
+		for _, folder := range w.unseenFolders(root, folders, seen) {
+			if err := w.addWatchFolder(folder); err != nil {
+				if !w.options.BestEffort {
+					return fmt.Errorf("error adding watch folder: %w", err)
+				}
+				w.addErrors = append(w.addErrors, &WatchError{Op: "add", Path: folder, Err: err})
+			}
+		}
 	}
-
-	watchFolders := []string{}
-	for _, rootFolder := range w.options.RootFolders {
-		stat, err := os.Stat(rootFolder)
+	for parent := range w.expandedParents { // only its direct contents are listed, to catch new children
+		w.watcherMutex.Lock()
+		err := w.underlying().Add(parent)
+		w.watcherMutex.Unlock()
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error adding watch folder: %w", err)
 		}
-		watchFolders = w.addDirs(rootFolder, watchFolders, fs.FileInfoToDirEntry(stat))
 	}
-	return watchFolders, nil
-}
-
-func (w *Filewatcher) addDirs(path string, folders []string, item fs.DirEntry) []string {
-	if !item.IsDir() || (!w.options.IncludeHidden && isHiddenFolder(path)) || w.isExcludedFolder(path) {
-		return folders
+	for _, file := range w.options.RootFiles {
+		if isFolder(file) {
+			if !w.options.BestEffort {
+				return fmt.Errorf("root file %s is a directory", file)
+			}
+			w.addErrors = append(w.addErrors, &WatchError{Op: "add", Path: file, Err: errors.New("root file is a directory")})
+			continue
+		}
+		if err := w.underlying().Add(file); err != nil {
+			if !w.options.BestEffort {
+				return fmt.Errorf("error adding watch file: %w", err)
+			}
+			w.addErrors = append(w.addErrors, &WatchError{Op: "add", Path: file, Err: err})
+		}
 	}
-
-	folders = append(folders, path)
-	return append(folders, w.getFolders(path)...)
+	return nil
 }
 
-func (w *Filewatcher) getFolders(path string) []string {
-	filesAndFolders, _ := os.ReadDir(path)
+// newWatcher creates an underlying watcher for the Backend option which applies the hidden file and exclude pattern
+// options
+func (w *Filewatcher) newWatcher() (Watcher, error) {
+	if w.options.NewWatcher != nil {
+		return w.options.NewWatcher()
+	}
+	ignoreHidden := !w.includeHiddenFiles() && !w.includeHiddenFolders() && !w.options.Watchignore
+	hooks := []watcher.FilterFileHookFunc{}
+	if !w.includeHiddenFiles() && !ignoreHidden { // the underlying watcher can't ignore only some hidden files, so skip them here instead
+		includeHiddenFolders := w.includeHiddenFolders()
+		hooks = append(hooks, func(info os.FileInfo, fullPath string) error {
+			if isHiddenFile(fullPath) && (!info.IsDir() || !includeHiddenFolders) && filepath.Base(fullPath) != watchignoreFile {
+				return watcher.ErrSkip
+			}
+			return nil
+		})
+	}
+	hooks = append(hooks, func(info os.FileInfo, fullPath string) error { // skip excluded files up front so the underlying watcher doesn't have to track them
+		filter := w.filter.Load().(*fileFilter)
+		if filter.roots[filepath.Dir(fullPath)] {
+			w.polled() // the underlying watcher doesn't report poll cycles, but lists the contents of the root folders in each of them
+		}
+		if !info.IsDir() && filter.skips(fullPath, info) {
+			return watcher.ErrSkip
+		}
+		return nil
+	})
+	if w.options.Backend == BackendNative {
+		return newNativeBackend(ignoreHidden, hooks)
+	}
 
-	folders := []string{}
-	for _, item := range filesAndFolders {
-		fullPath := filepath.Join(path, item.Name())
-		folders = w.addDirs(fullPath, folders, item)
+	underlying := watcher.New()
+	underlying.IgnoreHiddenFiles(ignoreHidden)
+	for _, hook := range hooks {
+		underlying.AddFilterHook(hook)
 	}
-	return folders
+	return pollBackend{underlying}, nil
 }
 
-func prepareFolders(folders []string) []string {
-	for i := 0; i < len(folders); i++ {
-		folder := strings.Trim(folders[i], `/\`) // trim leading and trailing folder separators for consistency
-		if len(folder) == 0 {                    // remove empty folder from slice
-			folders = append(folders[:i], folders[i+1:]...)
-			i--
+// refreshFilter replaces the snapshot of the options used by the filter hook. It must be called whenever the options or
+// root folders change. The mutex must be held by the caller
+func (w *Filewatcher) refreshFilter() {
+	options := w.options
+	filter := &fileFilter{options: &options, roots: make(map[string]bool), rootOptions: make(map[string]*Options, len(w.rootOptions))}
+	for _, root := range w.roots() {
+		absRoot, _ := filepath.Abs(root.Path)
+		filter.roots[absRoot] = true
+		if len(w.rootOptions) == 0 {
 			continue
 		}
-		folders[i] = fmt.Sprintf("%c%s%c", filepath.Separator, folder, filepath.Separator) // add leading and trailing separator
+		prefix := strings.TrimSuffix(absRoot, string(filepath.Separator)) + string(filepath.Separator)
+		filter.prefixes = append(filter.prefixes, prefix)
+		if settings := w.rootOptions[absRoot]; settings != nil {
+			filter.rootOptions[prefix] = &settings.options
+		}
 	}
-	return folders
+	w.filter.Store(filter)
 }
 
-func isHiddenFolder(path string) bool {
-	dir := filepath.Base(path)
-	if dir == "." { // dot by itself represents current folder, so we need to get the absolute path
-		fullPath, _ := filepath.Abs(path)
-		dir = filepath.Base(fullPath)
+// underlying returns the current underlying watcher
+func (w *Filewatcher) underlying() Watcher {
+	return w.watcher.Load().(Watcher)
+}
+
+// SetPollDuration changes how often the filesystem is polled, even while the watcher is running, in which case the
+// underlying watcher is replaced by one using the new duration. When Options.DebounceDuration wasn't set, the debounce
+// duration follows as 2x the pollDuration. Otherwise it, along with any DebounceByPattern durations, must still be
+// greater than the new pollDuration
+func (w *Filewatcher) SetPollDuration(pollDuration time.Duration) error {
+	w.watcherMutex.Lock()
+	defer w.watcherMutex.Unlock()
+	w.mutex.Lock()
+	if !w.defaultDebounce && w.debounceDuration <= pollDuration {
+		w.mutex.Unlock()
+		return fmt.Errorf("debounce duration %s must be greater than poll duration %s", w.debounceDuration, pollDuration)
 	}
-	if strings.HasPrefix(dir, ".") {
-		return true
+	if err := validateDebounceByPattern(w.options.DebounceByPattern, pollDuration); err != nil {
+		w.mutex.Unlock()
+		return err
+	}
+	w.pollDuration = pollDuration
+	if w.defaultDebounce {
+		w.debounceDuration = 2 * pollDuration
+		w.options.DebounceDuration = w.debounceDuration
+	}
+	running := w.running && (w.options.Backend == BackendPoll || w.options.NewWatcher != nil) // the native backend doesn't poll
+	folders := w.underlyingFolders()
+	w.mutex.Unlock()
+	if !running {
+		return nil // picked up by Start
 	}
-	return false
-}
 
-func (w *Filewatcher) isExcludedFolder(path string) bool {
-	pathWithSlashes := string(filepath.Separator) + path + string(filepath.Separator)
-	for _, excludedFolder := range w.options.FolderExclusions {
-		if strings.Contains(pathWithSlashes, excludedFolder) { // match against full folder name or subdir. partial names not allowed
-			return true
-		}
+	if err := w.replaceWatcher(folders); err != nil {
+		return err
 	}
-	return false
+	w.debugf("poll duration changed to %s", pollDuration)
+	return nil
 }
 
-// WatchFolders returns the current list of folders being watched by gobounce
-func (w *Filewatcher) WatchFolders() []string {
-	folders := make(map[string]bool)
-	folderSlice := []string{}
-	for filename := range w.watcher.WatchedFiles() {
-		stat, _ := os.Stat(filename)
-		if stat != nil && stat.IsDir() {
-			continue
-		}
-
-		dir := filepath.Dir(filename)
-		if !folders[dir] {
-			folders[dir] = true
-			folderSlice = append(folderSlice, dir)
-		}
+// SetIncludeHidden shows or hides hidden files and folders from now on, replacing the IncludeHidden,
+// IncludeHiddenFiles and IncludeHiddenFolders options. The underlying watcher is replaced by one using the new setting,
+// unless it was created by Options.NewWatcher, and the watch set is rebuilt by Restart, so pending notifications are
+// discarded. It is safe to call while the watcher is running
+func (w *Filewatcher) SetIncludeHidden(include bool) error {
+	w.watcherMutex.Lock()
+	select {
+	case <-w.done:
+		w.watcherMutex.Unlock()
+		return os.ErrClosed
+	default:
 	}
-	sort.Strings(folderSlice)
-	return folderSlice
+	w.mutex.Lock()
+	w.options.IncludeHidden, w.options.IncludeHiddenFiles, w.options.IncludeHiddenFolders = include, include, include
+	replace := w.options.NewWatcher == nil // a custom watcher doesn't apply the hidden file settings
+	folders := w.underlyingFolders()
+	w.mutex.Unlock()
+	var err error
+	if replace {
+		err = w.replaceWatcher(folders)
+	}
+	w.watcherMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	w.debugf("hidden files and folders included: %t", include)
+	return w.Restart() // add or remove the hidden folders
 }
 
-func (w *Filewatcher) Start() {
-	go w.listen()
-
-	w.watcher.Start(w.pollDuration)
+// underlyingFolders returns the sorted absolute paths of the folders added to the underlying watcher. The mutex must be
+// held by the caller
+func (w *Filewatcher) underlyingFolders() []string {
+	folders := make([]string, 0, len(w.folders)+len(w.expandedParents))
+	for folder := range w.folders {
+		folders = append(folders, folder)
+	}
+	for parent := range w.expandedParents {
+		folders = append(folders, parent)
+	}
+	sort.Strings(folders)
+	return folders
 }
 
-func (w *Filewatcher) listen() {
-	for {
-		select {
-		case e := <-w.watcher.Event:
-			w.debounce(e)
-		case err := <-w.watcher.Error:
-			w.Error <- err
-		case <-w.watcher.Closed:
-			return
+// replaceWatcher swaps the underlying watcher for a new one watching the folders and the root files. poll and listen
+// carry on with the replacement once the previous one is closed. The watcherMutex must be held by the caller
+func (w *Filewatcher) replaceWatcher(folders []string) error {
+	w.mutex.Lock()
+	replacement, err := w.newWatcher()
+	rootFiles := append([]string(nil), w.options.RootFiles...)
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		if err := replacement.Add(folder); err != nil {
+			replacement.Close()
+			return fmt.Errorf("error adding watch folder: %w", err)
 		}
 	}
+	for _, file := range rootFiles {
+		if err := replacement.Add(file); err != nil {
+			replacement.Close()
+			return fmt.Errorf("error adding watch file: %w", err)
+		}
+	}
+	previous := w.underlying()
+	w.watcher.Store(replacement)
+	if err := previous.Close(); err != nil {
+		w.debugf("error closing the replaced watcher: %v", err)
+	}
+	return nil
 }
 
-func (w *Filewatcher) Close() {
-	w.watcher.Close()
-	close(w.FileChanged)
-	close(w.FolderChanged)
+// poll runs the poll loop of the underlying watcher until it is closed, carrying on with the replacement whenever
+// SetPollDuration replaces it
+func (w *Filewatcher) poll() error {
+	for {
+		current := w.underlying()
+		w.mutex.Lock()
+		pollDuration := w.pollDuration
+		w.mutex.Unlock()
+		if err := current.Start(pollDuration); err != nil {
+			return err
+		}
+		if w.underlying() == current {
+			return nil // closed rather than replaced
+		}
+	}
 }
 
-func (w *Filewatcher) debounce(e watcher.Event) {
-	path, _ := filepath.Abs(getWatcherPath(e.Path))
-	if path == "" {
-		return
+// AddFolder adds a new root folder, along with its subfolders, to the watch list using the same exclusion and hidden
+// folder rules as the initial RootFolders. It is safe to call while the watcher is running
+func (w *Filewatcher) AddFolder(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
 	}
-
-	if (e.Op == watcher.Create || e.Op == watcher.Move || e.Op == watcher.Rename) && e.IsDir() &&
-		w.options.FollowNewFolders && !w.isExcludedFolder(path) && (w.options.IncludeHidden || !isHiddenFolder(path)) {
-		w.watcher.Add(path)
+	if _, err := os.Stat(path); err != nil {
+		return err
 	}
 
 	w.mutex.Lock()
-	if e.IsDir() {
-		w.debounceItem(w.folderDebounce, path, w.FolderChanged)
-	} else {
-		w.debounceItem(w.fileDebounce, path, w.FileChanged)
-		w.debounceItem(w.folderDebounce, filepath.Dir(path), w.FolderChanged)
+	if w.folders[absPath] {
+		w.mutex.Unlock()
+		return fmt.Errorf("folder %s is already being watched", path)
 	}
+	if w.options.Watchignore {
+		w.loadWatchignore(absPath)
+	}
+	folders, err := w.getRootFolders(RootFolder{Path: path, Recursive: !w.options.ExcludeSubdirs})
 	w.mutex.Unlock()
-}
+	if err != nil {
+		return fmt.Errorf("error determining watch folders: %w", err)
+	}
 
-func (w *Filewatcher) debounceItem(debounceMap map[string]*time.Timer, path string, notifyChannel chan string) {
-	timer, ok := debounceMap[path]
-	if !ok {
-		timer = time.NewTimer(w.debounceDuration)
-		debounceMap[path] = timer
-		go w.waitDebounceTimer(timer, debounceMap, path, notifyChannel)
-	} else {
-		timer.Reset(w.debounceDuration)
+	for _, folder := range folders {
+		if err := w.addWatchFolder(folder); err != nil {
+			return fmt.Errorf("error adding watch folder: %w", err)
+		}
 	}
+	w.mutex.Lock()
+	w.options.RootFolders = append(w.options.RootFolders, path)
+	w.refreshFilter()
+	w.mutex.Unlock()
+	return nil
 }
 
-func (w *Filewatcher) waitDebounceTimer(timer *time.Timer, debounceMap map[string]*time.Timer, path string, notifyChannel chan string) {
-	<-timer.C
-	timer.Stop()
+// RemoveFolder stops watching the folder and all of its subfolders and cancels any pending notifications for paths
+// within it. It is safe to call while the watcher is running
+func (w *Filewatcher) RemoveFolder(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
 
 	w.mutex.Lock()
-	delete(debounceMap, path)
-	w.mutex.Unlock()
-
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return // file has been deleted since we started the timer, so ignore
+	if !w.folders[absPath] {
+		w.mutex.Unlock()
+		return fmt.Errorf("folder %s is not being watched", path)
 	}
-	notifyChannel <- path
+	folders := w.unwatchFolder(absPath)
+	w.mutex.Unlock()
+	return w.removeWatchFolders(folders)
 }
 
-func getWatcherPath(path string) string {
-	// Rename and Move events path is in the format of fromPath -> toPath according to https://github.com/radovskyb/watcher
-	toPathIndex := strings.Index(path, "-> ")
-	if toPathIndex != -1 {
-		return path[toPathIndex+3:]
+// unwatchFolder forgets the folder and all of its subfolders, including any root folders within it, cancels any
+// pending notifications for paths within it and returns the folders which must be removed from the underlying
+// watcher. The mutex must be held by the caller
+func (w *Filewatcher) unwatchFolder(absPath string) []string {
+	folders := []string{}
+	for folder := range w.folders {
+		if isSubpath(folder, absPath) {
+			folders = append(folders, folder)
+			delete(w.folders, folder)
+		}
 	}
-
-	return path
+	rootFolders := []string{}
+	for _, rootFolder := range w.options.RootFolders {
+		if absRoot, _ := filepath.Abs(rootFolder); !isSubpath(absRoot, absPath) {
+			rootFolders = append(rootFolders, rootFolder)
+		}
+	}
+	w.options.RootFolders = rootFolders
+	exactFolders := []string{}
+	for _, folder := range w.options.ExactFolders {
+		if absFolder, _ := filepath.Abs(folder); !isSubpath(absFolder, absPath) {
+			exactFolders = append(exactFolders, folder)
+		}
+	}
+	w.options.ExactFolders = exactFolders
+	roots := []RootFolder{}
+	for _, root := range w.options.Roots {
+		if absRoot, _ := filepath.Abs(root.Path); !isSubpath(absRoot, absPath) {
+			roots = append(roots, root)
+		}
+	}
+	w.options.Roots = roots
+	for root := range w.rootOptions {
+		if isSubpath(root, absPath) {
+			delete(w.rootOptions, root)
+		}
+	}
+	w.refreshFilter()
+	for root := range w.watchignore {
+		if isSubpath(root, absPath) {
+			delete(w.watchignore, root)
+		}
+	}
+	for folder := range w.skipped {
+		if isSubpath(folder, absPath) {
+			delete(w.skipped, folder)
+		}
+	}
+	w.cancelDebounce(w.fileDebounce, absPath)
+	w.cancelDebounce(w.folderDebounce, absPath)
+	return folders
+}
+
+// removeWatchFolders removes the folders from the underlying watcher. The mutex must not be held by the caller
+func (w *Filewatcher) removeWatchFolders(folders []string) error {
+	sort.Sort(sort.Reverse(sort.StringSlice(folders))) // remove subfolders before their parents so their files are removed too
+	w.watcherMutex.Lock()
+	defer w.watcherMutex.Unlock()
+	for _, folder := range folders {
+		if err := w.underlying().Remove(folder); err != nil {
+			return fmt.Errorf("error removing watch folder: %w", err)
+		}
+	}
+	return nil
+}
+
+// Restart re-scans the root folders and rebuilds the watch set, adding any folders which were missed and removing
+// folders which no longer belong to it, and discards any pending notifications. The underlying watcher and the
+// notification channels are kept as they are, so it is safe to call while the watcher is running
+func (w *Filewatcher) Restart() error {
+	w.mutex.Lock()
+	w.clearDebounce(w.fileDebounce)
+	w.clearDebounce(w.folderDebounce)
+	w.skipped = nil
+	watchFolders, err := w.getWatchFolders()
+	wanted := make(map[string]bool, len(watchFolders))
+	for _, folder := range watchFolders {
+		absFolder, _ := filepath.Abs(folder)
+		wanted[absFolder] = true
+	}
+	stale := []string{}
+	for folder := range w.folders {
+		if err == nil && !wanted[folder] {
+			stale = append(stale, folder)
+			delete(w.folders, folder)
+		}
+	}
+	w.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("error determining watch folders: %w", err)
+	}
+
+	if err := w.removeWatchFolders(stale); err != nil {
+		return err
+	}
+	for _, folder := range watchFolders { // folders which are already watched are listed again to refresh them
+		if err := w.addWatchFolder(folder); err != nil {
+			return fmt.Errorf("error adding watch folder: %w", err)
+		}
+	}
+	w.debugf("restarted with %d watch folders", len(watchFolders))
+	return nil
+}
+
+// clearDebounce stops all of the pending timers. The mutex must be held by the caller
+func (w *Filewatcher) clearDebounce(debounceMap map[string]*debounceEntry) {
+	for path, entry := range debounceMap {
+		w.stopTimer(entry)
+		delete(debounceMap, path)
+	}
+}
+
+// cancelDebounce stops the pending timers for all paths within the folder. The mutex must be held by the caller
+func (w *Filewatcher) cancelDebounce(debounceMap map[string]*debounceEntry, folder string) {
+	for path, entry := range debounceMap {
+		if isSubpath(path, folder) {
+			w.stopTimer(entry)
+			delete(debounceMap, path)
+		}
+	}
+}
+
+// isSubpath returns true if the path is the folder itself or anywhere below it
+func isSubpath(path, folder string) bool {
+	return path == folder || strings.HasPrefix(path, strings.TrimSuffix(folder, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// addWatchFolder adds the folder to the underlying watcher. The mutex must not be held by the caller since the
+// underlying watcher can block on event delivery while holding its own lock
+func (w *Filewatcher) addWatchFolder(folder string) error {
+	w.mutex.Lock()
+	retries, delay := w.options.AddRetries, w.options.AddRetryDelay
+	w.mutex.Unlock()
+	if delay <= 0 {
+		delay = defaultAddRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		w.watcherMutex.Lock()
+		err := w.underlying().Add(folder)
+		w.watcherMutex.Unlock()
+		if err == nil {
+			break
+		}
+		if attempt >= retries || os.IsNotExist(err) {
+			return err
+		}
+		w.debugf("retrying adding folder %s in %s: %v", folder, delay, err)
+		if !w.sleep(delay) {
+			return err
+		}
+		delay *= 2
+	}
+	absFolder, _ := filepath.Abs(folder)
+	w.mutex.Lock()
+	w.folders[absFolder] = true
+	w.mutex.Unlock()
+	return nil
+}
+
+// defaultAddRetryDelay is the delay before the first retry when Options.AddRetryDelay isn't set
+const defaultAddRetryDelay = 100 * time.Millisecond
+
+func (w *Filewatcher) retriesAdd() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.options.AddRetries > 0
+}
+
+// sleep waits for the duration. It returns false if the watcher was closed first
+func (w *Filewatcher) sleep(d time.Duration) bool {
+	timer := w.clock.NewTimer(d)
+	select {
+	case <-timer.C():
+		return true
+	case <-w.done:
+		timer.Stop()
+		return false
+	}
+}
+
+// PlanWatch returns the folders New would watch for the options without creating a watcher. Folders which would be
+// skipped are reported to the Logger along with the reason, which makes it useful for checking FolderExclusions and
+// MaxDepth before watching
+func PlanWatch(options Options) ([]string, error) {
+	w := &Filewatcher{options: options.clone(), logger: options.Logger, watchignore: make(map[string][]string)}
+	if err := w.setup(); err != nil {
+		return nil, err
+	}
+	return w.getWatchFolders()
+}
+
+func (w *Filewatcher) getWatchFolders() ([]string, error) {
+	watchFolders := []string{}
+	seen := make(map[string]bool)
+	for _, root := range w.roots() {
+		folders, err := w.getRootFolders(root)
+		if err != nil {
+			return nil, err
+		}
+		watchFolders = append(watchFolders, w.unseenFolders(root, folders, seen)...)
+	}
+	return watchFolders, nil
+}
+
+// setup prepares the options and determines the root folders, along with their .watchignore patterns, before the
+// folders are listed. It's shared by New and PlanWatch so that they list the same folders
+func (w *Filewatcher) setup() error {
+	folderPatterns, err := prepareOptions(&w.options)
+	if err != nil {
+		return err
+	}
+	w.folderPatterns = folderPatterns
+	if w.options.ExpandChildrenAsRoots {
+		if err := w.expandChildren(); err != nil {
+			return err
+		}
+	}
+	if w.options.Watchignore {
+		for _, root := range w.roots() {
+			absRoot, _ := filepath.Abs(root.Path)
+			w.loadWatchignore(absRoot)
+		}
+	}
+	return nil
+}
+
+// expandChildren replaces the RootFolders with their subfolders. With FollowNewFolders, the RootFolders are kept as
+// expandedParents so that they can be watched for new subfolders
+func (w *Filewatcher) expandChildren() error {
+	children := []string{}
+	for _, parent := range w.options.RootFolders {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			return fmt.Errorf("error listing root folder: %w", err)
+		}
+		for _, entry := range entries {
+			child := filepath.Join(parent, entry.Name())
+			if !w.isDirEntry(child, entry) {
+				continue
+			}
+			if reason := w.skipReason(child, 0); reason != "" {
+				w.skipFolder(child, reason)
+				continue
+			}
+			children = append(children, child)
+		}
+		if w.options.FollowNewFolders {
+			absParent, _ := filepath.Abs(parent)
+			if w.expandedParents == nil {
+				w.expandedParents = make(map[string]bool)
+			}
+			w.expandedParents[absParent] = true
+		}
+	}
+	w.options.RootFolders = children
+	return nil
+}
+
+// isNewChild returns true if the event is for a subfolder which appeared within one of the expandedParents and should
+// be added as a root. The mutex must be held
+func (w *Filewatcher) isNewChild(e watcher.Event, path string) bool {
+	appeared := e.Op == watcher.Create || e.Op == watcher.Move || e.Op == watcher.Rename
+	return appeared && e.IsDir() && w.expandedParents[filepath.Dir(path)] && !w.folders[path] && w.skipReason(path, 0) == ""
+}
+
+// rootWalk holds the folders listed for a root folder
+type rootWalk struct {
+	root    RootFolder
+	folders []string
+	skipped map[string]string
+	err     error
+}
+
+// walkRoots lists the folders of each root in order. With a WalkTimeout, the roots which weren't listed in time are
+// returned with ErrWalkTimeout. Since a hung file system can't be interrupted, the walk carries on in the background
+// using a copy of the settings and its remaining results are discarded
+func (w *Filewatcher) walkRoots() []rootWalk {
+	roots := w.roots()
+	walks := make([]rootWalk, 0, len(roots))
+	if w.options.WalkTimeout <= 0 {
+		for _, root := range roots {
+			folders, err := w.getRootFolders(root)
+			walks = append(walks, rootWalk{root: root, folders: folders, err: err})
+		}
+		return walks
+	}
+
+	walker := w.walker()
+	results := make(chan rootWalk, len(roots)) // buffered so that an abandoned walk can still finish
+	go func() {
+		for _, root := range roots {
+			folders, err := walker.getRootFolders(root)
+			results <- rootWalk{root: root, folders: folders, skipped: walker.skipped, err: err}
+			walker.skipped = nil
+		}
+	}()
+	timer := w.clock.NewTimer(w.options.WalkTimeout)
+	defer timer.Stop()
+	for len(walks) < len(roots) {
+		select {
+		case walk := <-results:
+			for path, reason := range walk.skipped {
+				w.recordSkipped(path, reason)
+			}
+			walks = append(walks, walk)
+		case <-timer.C():
+			for _, root := range roots[len(walks):] {
+				walks = append(walks, rootWalk{root: root, err: fmt.Errorf("%w after %s", ErrWalkTimeout, w.options.WalkTimeout)})
+			}
+		}
+	}
+	return walks
+}
+
+// walker returns a copy of the settings used to list folders, which stays unaffected by later changes to the watcher
+func (w *Filewatcher) walker() *Filewatcher {
+	walker := &Filewatcher{
+		options:        w.options.clone(),
+		folderPatterns: w.folderPatterns,
+		logger:         w.logger,
+		rootOptions:    make(map[string]*rootSettings, len(w.rootOptions)),
+		watchignore:    make(map[string][]string, len(w.watchignore)),
+	}
+	for root, settings := range w.rootOptions {
+		walker.rootOptions[root] = settings
+	}
+	for root, patterns := range w.watchignore {
+		walker.watchignore[root] = patterns
+	}
+	return walker
+}
+
+// unseenFolders returns the root's folders which weren't already listed for an earlier root, recording them as seen.
+// This keeps overlapping roots, such as a root nested within another, from watching the same folder twice
+func (w *Filewatcher) unseenFolders(root RootFolder, folders []string, seen map[string]bool) []string {
+	unseen := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		absFolder, _ := filepath.Abs(folder)
+		if !seen[absFolder] {
+			seen[absFolder] = true
+			unseen = append(unseen, folder)
+		}
+	}
+	if len(unseen) < len(folders) {
+		w.debugf("root folder %s overlaps another root folder, so %d of its folders are only watched once", root.Path, len(folders)-len(unseen))
+	}
+	return unseen
+}
+
+// prepareOptions normalizes the folder exclusions and file patterns in the options and compiles the folder exclusion
+// patterns
+func prepareOptions(options *Options) ([]*regexp.Regexp, error) {
+	if options.FolderEventsOnly && options.FileEventsOnly {
+		return nil, errors.New("FolderEventsOnly and FileEventsOnly can't both be set")
+	}
+	if options.CollapseToRoot && options.FileEventsOnly {
+		return nil, errors.New("CollapseToRoot and FileEventsOnly can't both be set")
+	}
+	if options.GroupByFolder && options.BatchWindow <= 0 {
+		return nil, errors.New("GroupByFolder requires a BatchWindow")
+	}
+	if options.CaseInsensitive {
+		options.FolderExclusions = lowercase(options.FolderExclusions)
+		options.IncludePatterns = lowercase(options.IncludePatterns)
+		options.ExcludePatterns = lowercase(options.ExcludePatterns)
+	}
+	options.FolderExclusions = prepareFolders(options.FolderExclusions)
+	watchExtensions := make([]string, 0, len(options.WatchExtensions))
+	for _, ext := range options.WatchExtensions {
+		if ext = strings.TrimPrefix(ext, "."); ext == "" {
+			continue
+		}
+		if options.CaseInsensitive {
+			ext = strings.ToLower(ext)
+		}
+		watchExtensions = append(watchExtensions, "."+ext)
+	}
+	options.WatchExtensions = watchExtensions
+	excludePrefixes := make([]string, 0, len(options.ExcludePrefixes))
+	for _, prefix := range options.ExcludePrefixes {
+		absPrefix, err := filepath.Abs(toSeparator(prefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude prefix: %w", err)
+		}
+		if options.CaseInsensitive {
+			absPrefix = strings.ToLower(absPrefix)
+		}
+		excludePrefixes = append(excludePrefixes, absPrefix)
+	}
+	options.ExcludePrefixes = excludePrefixes
+	var folderPatterns []*regexp.Regexp
+	for _, pattern := range options.FolderExclusionPatterns {
+		if options.CaseInsensitive {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid folder exclusion pattern: %w", err)
+		}
+		folderPatterns = append(folderPatterns, re)
+	}
+	if err := validatePatterns(options.IncludePatterns); err != nil {
+		return nil, fmt.Errorf("invalid include pattern: %w", err)
+	}
+	if err := validatePatterns(options.ExcludePatterns); err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+	if options.CaseInsensitive {
+		options.FollowNewFoldersPattern = strings.ToLower(options.FollowNewFoldersPattern)
+	}
+	if err := validatePatterns([]string{options.FollowNewFoldersPattern}); err != nil {
+		return nil, fmt.Errorf("invalid follow new folders pattern: %w", err)
+	}
+	debounceByPattern := make(map[string]time.Duration, len(options.DebounceByPattern))
+	for pattern, duration := range options.DebounceByPattern {
+		if options.CaseInsensitive {
+			pattern = strings.ToLower(pattern)
+		}
+		if err := validatePatterns([]string{pattern}); err != nil {
+			return nil, fmt.Errorf("invalid debounce pattern: %w", err)
+		}
+		debounceByPattern[pattern] = duration
+	}
+	options.DebounceByPattern = debounceByPattern
+	return folderPatterns, nil
+}
+
+func validateDebounceByPattern(debounceByPattern map[string]time.Duration, pollDuration time.Duration) error {
+	for pattern, duration := range debounceByPattern {
+		if duration <= pollDuration {
+			return fmt.Errorf("debounce duration %s for %q must be greater than poll duration %s", duration, pattern, pollDuration)
+		}
+	}
+	return nil
+}
+
+// GetOptions returns a copy of the options currently in use. FolderExclusions are returned in their normalized form
+func (w *Filewatcher) GetOptions() Options {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.options.clone()
+}
+
+// UpdateOptions replaces the options used to filter and publish notifications while the watcher is running. The folder
+// exclusions apply to folders followed from now on. Options which are fixed once the watcher is created are kept as
+// they were: the watched folders and files, which can be changed with AddFolder and RemoveFolder, the hidden file
+// settings, which can be changed with SetIncludeHidden, along with ExcludeSubdirs, MaxConcurrency, ChannelBufferSize,
+// DebounceDuration, the Clock, the Logger, the Backend and NewWatcher
+func (w *Filewatcher) UpdateOptions(options Options) error {
+	options = options.clone()
+	folderPatterns, err := prepareOptions(&options)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if options.MaxDebounceDuration != 0 && options.MaxDebounceDuration < w.debounceDuration {
+		return fmt.Errorf("max debounce duration %s must not be less than debounce duration %s", options.MaxDebounceDuration, w.debounceDuration)
+	}
+	if err := validateDebounceByPattern(options.DebounceByPattern, w.pollDuration); err != nil {
+		return err
+	}
+	current := w.options
+	options.RootFolders, options.Roots, options.RootFiles = current.RootFolders, current.Roots, current.RootFiles
+	options.ExactFolders = current.ExactFolders
+	options.ExcludeSubdirs = current.ExcludeSubdirs
+	options.MaxConcurrency, options.ChannelBufferSize = current.MaxConcurrency, current.ChannelBufferSize
+	options.DebounceDuration = current.DebounceDuration
+	options.IncludeHidden, options.IncludeHiddenFiles, options.IncludeHiddenFolders = current.IncludeHidden, current.IncludeHiddenFiles, current.IncludeHiddenFolders
+	options.Clock, options.Logger, options.Backend, options.NewWatcher = current.Clock, current.Logger, current.Backend, current.NewWatcher
+	w.options = options
+	w.folderPatterns = folderPatterns
+	w.refreshFilter()
+	return nil
+}
+
+// clone returns a copy of the options which doesn't share any slices with the original
+func (o Options) clone() Options {
+	o.RootFolders = append([]string(nil), o.RootFolders...)
+	o.Roots = append([]RootFolder(nil), o.Roots...)
+	o.RootFiles = append([]string(nil), o.RootFiles...)
+	o.ExactFolders = append([]string(nil), o.ExactFolders...)
+	o.FolderExclusions = append([]string(nil), o.FolderExclusions...)
+	o.IncludePatterns = append([]string(nil), o.IncludePatterns...)
+	o.ExcludePatterns = append([]string(nil), o.ExcludePatterns...)
+	o.WatchExtensions = append([]string(nil), o.WatchExtensions...)
+	o.FolderExclusionPatterns = append([]string(nil), o.FolderExclusionPatterns...)
+	o.ExcludePrefixes = append([]string(nil), o.ExcludePrefixes...)
+	debounceByPattern := make(map[string]time.Duration, len(o.DebounceByPattern))
+	for pattern, duration := range o.DebounceByPattern {
+		debounceByPattern[pattern] = duration
+	}
+	o.DebounceByPattern = debounceByPattern
+	return o
+}
+
+// roots returns the RootFolders, with recursion determined by ExcludeSubdirs, followed by the Roots and then the
+// ExactFolders, which aren't recursive
+func (w *Filewatcher) roots() []RootFolder {
+	roots := make([]RootFolder, 0, len(w.options.RootFolders)+len(w.options.Roots)+len(w.options.ExactFolders))
+	for _, rootFolder := range w.options.RootFolders {
+		roots = append(roots, RootFolder{Path: rootFolder, Recursive: !w.options.ExcludeSubdirs})
+	}
+	roots = append(roots, w.options.Roots...)
+	for _, folder := range w.options.ExactFolders {
+		roots = append(roots, RootFolder{Path: folder})
+	}
+	return roots
+}
+
+func (w *Filewatcher) getRootFolders(root RootFolder) ([]string, error) {
+	stat, err := os.Stat(root.Path)
+	if err == nil && !stat.IsDir() {
+		return nil, fmt.Errorf("root folder %s is not a directory", root.Path)
+	}
+	if !root.Recursive {
+		return []string{root.Path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w.addDirs(root.Path, []string{}, fs.FileInfoToDirEntry(stat), 0, make(map[string]bool)), nil
+}
+
+// addDirs adds the folder and its subfolders. The visited map holds the real paths of the folders which have already
+// been added so that symlinks pointing back up the tree don't cause infinite recursion
+func (w *Filewatcher) addDirs(path string, folders []string, item fs.DirEntry, depth int, visited map[string]bool) []string {
+	if !w.isDirEntry(path, item) {
+		return folders
+	}
+	if reason := w.skipReason(path, depth); reason != "" {
+		w.skipFolder(path, reason)
+		return folders
+	}
+	if !w.filterEntry(path, item) {
+		w.skipFolder(path, "rejected by filter")
+		return folders
+	}
+	if realPath, err := filepath.EvalSymlinks(path); err == nil {
+		if visited[realPath] {
+			w.skipFolder(path, "already watched as "+realPath)
+			return folders
+		}
+		visited[realPath] = true
+	}
+
+	w.debugf("adding folder %s", path)
+	folders = append(folders, path)
+	return append(folders, w.getFolders(path, depth+1, visited)...)
+}
+
+func (w *Filewatcher) getFolders(path string, depth int, visited map[string]bool) []string {
+	filesAndFolders, _ := os.ReadDir(path) // read even when the subfolders are too deep so they're recorded as skipped
+
+	folders := []string{}
+	for _, item := range filesAndFolders {
+		fullPath := filepath.Join(path, item.Name())
+		folders = w.addDirs(fullPath, folders, item, depth, visited)
+	}
+	return folders
+}
+
+// skipFolder logs and records why the folder isn't watched
+func (w *Filewatcher) skipFolder(path, reason string) {
+	w.debugf("skipping folder %s: %s", path, reason)
+	absPath, _ := filepath.Abs(path)
+	w.recordSkipped(absPath, reason)
+}
+
+func (w *Filewatcher) recordSkipped(path, reason string) {
+	if w.skipped == nil {
+		w.skipped = make(map[string]string)
+	}
+	w.skipped[path] = reason
+}
+
+// SkippedFolders returns the folders, sorted by path, which were found while listing the root folders but aren't
+// watched, along with the reason for each. Only the topmost folder of a skipped tree is listed since its subfolders
+// are never looked at. Restart lists them afresh
+func (w *Filewatcher) SkippedFolders() []SkipInfo {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	skipped := make([]SkipInfo, 0, len(w.skipped))
+	for path, reason := range w.skipped {
+		skipped = append(skipped, SkipInfo{Path: path, Reason: reason})
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Path < skipped[j].Path })
+	return skipped
+}
+
+// isDirEntry returns true if the entry is a folder or, when following symlinks, a symlink to a folder
+func (w *Filewatcher) isDirEntry(path string, item fs.DirEntry) bool {
+	if item.IsDir() {
+		return true
+	}
+	return w.options.FollowSymlinks && item.Type()&fs.ModeSymlink != 0 && isFolder(path)
+}
+
+// skipReason returns why the folder shouldn't be watched or an empty string if it should be
+func (w *Filewatcher) skipReason(path string, depth int) string {
+	switch {
+	case !w.includeHiddenFolders() && isHiddenFolder(path):
+		return "hidden folder"
+	case w.isExcludedFolder(path):
+		return "excluded folder"
+	case w.isWatchignored(path):
+		return "matched by " + watchignoreFile
+	case w.isTooDeep(path, depth):
+		return "deeper than max depth"
+	}
+	return ""
+}
+
+// IsExcluded returns true if the path would be ignored because of the folder exclusions, file patterns, hidden file and
+// folder rules or MaxDepth. Paths which aren't existing folders are checked as files. The folders between the path and
+// its root folder are checked too since a folder within an excluded one is never watched
+func (w *Filewatcher) IsExcluded(path string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !isFolder(absPath) {
+		if !w.isIncludedFile(absPath) || (!w.includeHiddenFiles() && isHiddenFile(absPath)) ||
+			(w.options.IgnoreEditorTemp && w.matchesAny(editorTempPatterns, absPath)) {
+			return true
+		}
+		absPath = filepath.Dir(absPath)
+	}
+	root, depth := w.closestRoot(absPath)
+	for folder := absPath; ; folder, depth = filepath.Dir(folder), depth-1 {
+		if w.skipReason(folder, depth) != "" {
+			return true
+		}
+		if root == "" || folder == root || folder == filepath.Dir(folder) {
+			return false
+		}
+	}
+}
+
+// filterEntry returns true if there's no Filter or it accepts the entry
+func (w *Filewatcher) filterEntry(path string, item fs.DirEntry) bool {
+	if w.options.Filter == nil {
+		return true
+	}
+	info, err := item.Info()
+	if err != nil {
+		return false
+	}
+	return w.options.Filter(path, info)
+}
+
+func (w *Filewatcher) isTooDeep(path string, depth int) bool {
+	options, _ := w.optionsFor(path)
+	return options.MaxDepth > 0 && depth > options.MaxDepth
+}
+
+// optionsFor returns the options and compiled folder exclusion patterns which apply to the path. These are the root
+// folder's own options when created with NewMulti and the shared options otherwise
+func (w *Filewatcher) optionsFor(path string) (*Options, []*regexp.Regexp) {
+	if len(w.rootOptions) == 0 {
+		return &w.options, w.folderPatterns
+	}
+	absPath, _ := filepath.Abs(path) // folders are listed relative to their root folder when it was given as a relative path
+	root, _ := w.closestRoot(absPath)
+	if settings := w.rootOptions[root]; settings != nil {
+		return &settings.options, settings.folderPatterns
+	}
+	return &w.options, w.folderPatterns
+}
+
+// rootDepth returns the number of folder levels between the path and the closest root folder containing it or -1
+// if the path isn't within any of the root folders
+func (w *Filewatcher) rootDepth(path string) int {
+	_, depth := w.closestRoot(path)
+	return depth
+}
+
+// closestRoot returns the absolute path of the root folder with the longest prefix match for the path along with the
+// number of folder levels between them. The depth is -1 if the path isn't within any of the root folders
+func (w *Filewatcher) closestRoot(path string) (string, int) {
+	closest, depth := "", -1
+	for _, root := range w.roots() {
+		absRoot, _ := filepath.Abs(root.Path)
+		if !isSubpath(path, absRoot) {
+			continue
+		}
+		rel, _ := filepath.Rel(absRoot, path)
+		rootDepth := 0
+		if rel != "." {
+			rootDepth = strings.Count(rel, string(filepath.Separator)) + 1
+		}
+		if depth == -1 || rootDepth < depth {
+			closest, depth = absRoot, rootDepth
+		}
+	}
+	return closest, depth
+}
+
+func prepareFolders(folders []string) []string {
+	for i := 0; i < len(folders); i++ {
+		folder := strings.Trim(folders[i], `/\`) // trim leading and trailing folder separators for consistency
+		anchored := strings.HasPrefix(folder, "./") || strings.HasPrefix(folder, `.\`)
+		if anchored {
+			folder = strings.Trim(folder[2:], `/\`)
+		}
+		if len(folder) == 0 { // remove empty folder from slice
+			folders = append(folders[:i], folders[i+1:]...)
+			i--
+			continue
+		}
+		folders[i] = fmt.Sprintf("%c%s%c", filepath.Separator, toSeparator(folder), filepath.Separator) // add leading and trailing separator
+		if anchored {
+			folders[i] = "." + folders[i] // matched against the path relative to the root folder rather than anywhere within it
+		}
+	}
+	return folders
+}
+
+// toSeparator replaces both forward and back slashes with the OS separator, so that folders can be configured the same
+// way on every platform
+func toSeparator(path string) string {
+	return strings.NewReplacer("/", string(filepath.Separator), `\`, string(filepath.Separator)).Replace(path)
+}
+
+func isHiddenFolder(path string) bool {
+	dir := filepath.Base(path)
+	if dir == "." { // dot by itself represents current folder, so we need to get the absolute path
+		fullPath, _ := filepath.Abs(path)
+		dir = filepath.Base(fullPath)
+	}
+	if strings.HasPrefix(dir, ".") {
+		return true
+	}
+	return false
+}
+
+func isHiddenFile(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+func (w *Filewatcher) includeHiddenFiles() bool {
+	return w.options.IncludeHidden || w.options.IncludeHiddenFiles
+}
+
+func (w *Filewatcher) includeHiddenFolders() bool {
+	return w.options.IncludeHidden || w.options.IncludeHiddenFolders
+}
+
+func (w *Filewatcher) isExcludedFolder(path string) bool {
+	pathWithSlashes := string(filepath.Separator) + toSeparator(path) + string(filepath.Separator)
+	if w.options.CaseInsensitive {
+		pathWithSlashes = strings.ToLower(pathWithSlashes)
+	}
+	options, folderPatterns := w.optionsFor(path)
+	absPath, _ := filepath.Abs(path)
+	for _, excludedFolder := range options.FolderExclusions {
+		if strings.HasPrefix(excludedFolder, ".") {
+			if w.isAnchoredExclusion(absPath, excludedFolder) {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(pathWithSlashes, excludedFolder) { // match against full folder name or subdir. partial names not allowed
+			return true
+		}
+	}
+	for _, pattern := range folderPatterns {
+		if pattern.MatchString(absPath) {
+			return true
+		}
+	}
+	if w.options.CaseInsensitive {
+		absPath = strings.ToLower(absPath)
+	}
+	for _, prefix := range options.ExcludePrefixes {
+		if isSubpath(absPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAnchoredExclusion returns true if the folder exclusion starting with "./" matches the start of the path relative to
+// its closest root folder
+func (w *Filewatcher) isAnchoredExclusion(absPath, excludedFolder string) bool {
+	root, depth := w.closestRoot(absPath)
+	if depth <= 0 {
+		return false // the root folder itself, or outside of the root folders
+	}
+	relPath, err := filepath.Rel(root, absPath)
+	if err != nil {
+		return false
+	}
+	relWithSlashes := "." + string(filepath.Separator) + relPath + string(filepath.Separator)
+	if w.options.CaseInsensitive {
+		relWithSlashes = strings.ToLower(relWithSlashes)
+	}
+	return strings.HasPrefix(relWithSlashes, excludedFolder)
+}
+
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func lowercase(values []string) []string {
+	lower := make([]string, len(values))
+	for i, value := range values {
+		lower[i] = strings.ToLower(value)
+	}
+	return lower
+}
+
+func (w *Filewatcher) matchesAny(patterns []string, path string) bool {
+	return matchesPattern(patterns, path, w.options.CaseInsensitive)
+}
+
+// matchesPattern returns true if the base name of the path matches any of the filepath.Match patterns
+func matchesPattern(patterns []string, path string, caseInsensitive bool) bool {
+	name := filepath.Base(path)
+	if caseInsensitive {
+		name = strings.ToLower(name)
+	}
+	for _, pattern := range patterns {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Filewatcher) isIncludedFile(path string) bool {
+	options, _ := w.optionsFor(path)
+	if w.matchesAny(options.ExcludePatterns, path) || !hasWatchedExtension(options, path) || w.isWatchignored(path) { // exclude wins over include
+		return false
+	}
+	if _, ok := w.watchignore[filepath.Dir(path)]; ok && w.options.Watchignore && filepath.Base(path) == watchignoreFile {
+		return false // only watched so that its patterns are reloaded
+	}
+	return len(options.IncludePatterns) == 0 || w.matchesAny(options.IncludePatterns, path)
+}
+
+// isNotifiedFile returns true if a change to the file would be notified, applying the same filters debounce does: the
+// Filter, the file patterns, editor temp files, hidden files and muted paths. The mutex must be held
+func (w *Filewatcher) isNotifiedFile(path string, info os.FileInfo) bool {
+	if w.options.Filter != nil && !w.options.Filter(path, info) {
+		return false
+	}
+	if !w.isIncludedFile(path) || (w.options.IgnoreEditorTemp && w.matchesAny(editorTempPatterns, path)) {
+		return false
+	}
+	return (w.includeHiddenFiles() || !isHiddenFile(path)) && !w.isMuted(path)
+}
+
+// watchignoreFile is the name of the file holding the patterns applied to each root folder with Options.Watchignore
+const watchignoreFile = ".watchignore"
+
+// loadWatchignore reads the patterns from the root folder's .watchignore file. A missing or unreadable file means there
+// are no patterns. The mutex must be held
+func (w *Filewatcher) loadWatchignore(root string) {
+	patterns := []string{}
+	contents, err := os.ReadFile(filepath.Join(root, watchignoreFile))
+	if err != nil && !os.IsNotExist(err) {
+		w.debugf("unable to read %s in %s: %v", watchignoreFile, root, err)
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if w.options.CaseInsensitive {
+			line = strings.ToLower(line)
+		}
+		if err := validatePatterns([]string{line}); err != nil {
+			w.debugf("skipping invalid pattern %q in %s: %v", line, filepath.Join(root, watchignoreFile), err)
+			continue
+		}
+		patterns = append(patterns, filepath.FromSlash(strings.Trim(line, "/")))
+	}
+	w.watchignore[root] = patterns
+}
+
+// isWatchignored returns true if the path, or a folder between it and its root folder, matches one of the root's
+// .watchignore patterns
+func (w *Filewatcher) isWatchignored(path string) bool {
+	if len(w.watchignore) == 0 {
+		return false
+	}
+	absPath, _ := filepath.Abs(path)
+	if w.options.CaseInsensitive {
+		absPath = strings.ToLower(absPath)
+	}
+	for root, patterns := range w.watchignore {
+		if w.options.CaseInsensitive {
+			root = strings.ToLower(root)
+		}
+		rel, err := filepath.Rel(root, absPath)
+		if err != nil || rel == "." || !isSubpath(absPath, root) {
+			continue
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		for i := range parts {
+			for _, pattern := range patterns {
+				target := parts[i]
+				if strings.ContainsRune(pattern, filepath.Separator) {
+					target = filepath.Join(parts[:i+1]...)
+				}
+				if match, _ := filepath.Match(pattern, target); match {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// hasWatchedExtension returns true if the file has one of the WatchExtensions or none are set
+func hasWatchedExtension(options *Options, path string) bool {
+	if len(options.WatchExtensions) == 0 {
+		return true
+	}
+	ext := filepath.Ext(path)
+	if options.CaseInsensitive {
+		ext = strings.ToLower(ext)
+	}
+	for _, watched := range options.WatchExtensions {
+		if ext == watched {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchFolders returns the current list of folders being watched by gobounce. It is safe to call while the watcher is
+// running, since it works from a copy of the underlying watcher's files
+func (w *Filewatcher) WatchFolders() []string {
+	folders := make(map[string]bool)
+	folderSlice := []string{}
+	for filename, info := range w.underlying().WatchedFiles() {
+		if isWatchedFolder(filename, info) {
+			continue
+		}
+
+		dir := filepath.Dir(filename)
+		if !folders[dir] {
+			folders[dir] = true
+			folderSlice = append(folderSlice, dir)
+		}
+	}
+	sort.Strings(folderSlice)
+	return folderSlice
+}
+
+// InitialFolders returns the absolute paths of the folders New added to the underlying watcher, sorted, e.g. for
+// logging what is watched at startup. Unlike WatchFolders, it includes empty folders and doesn't change as folders are
+// added or removed later
+func (w *Filewatcher) InitialFolders() []string {
+	return append([]string(nil), w.initialFolders...)
+}
+
+// IsWatching returns true if the folder, or root file, has been added to the underlying watcher and is still watched
+func (w *Filewatcher) IsWatching(path string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.folders[absPath] {
+		return true
+	}
+	for _, file := range w.options.RootFiles {
+		if absFile, _ := filepath.Abs(file); absFile == absPath {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchFolderCount returns the number of folders WatchFolders would return without building the sorted list
+func (w *Filewatcher) WatchFolderCount() int {
+	folders := make(map[string]bool)
+	for filename, info := range w.underlying().WatchedFiles() {
+		if !isWatchedFolder(filename, info) {
+			folders[filepath.Dir(filename)] = true
+		}
+	}
+	return len(folders)
+}
+
+// WatchFileCount returns the number of files, excluding folders, tracked by the underlying watcher
+func (w *Filewatcher) WatchFileCount() int {
+	count := 0
+	for filename, info := range w.underlying().WatchedFiles() {
+		if !isWatchedFolder(filename, info) {
+			count++
+		}
+	}
+	return count
+}
+
+// isWatchedFolder returns true if the entry tracked by the underlying watcher is a folder or a symlink to one
+func isWatchedFolder(path string, info os.FileInfo) bool {
+	return info.IsDir() || (info.Mode()&os.ModeSymlink != 0 && isFolder(path))
+}
+
+// WatchedFiles returns the sorted list of every file and folder known to the underlying watcher
+func (w *Filewatcher) WatchedFiles() []string {
+	watched := w.underlying().WatchedFiles()
+	files := make([]string, 0, len(watched))
+	for filename := range watched {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Stats returns a snapshot of the watcher's counters
+func (w *Filewatcher) Stats() WatcherStats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	stats := w.stats
+	stats.WatchedFolders = len(w.folders)
+	stats.PendingFileTimers = len(w.fileDebounce)
+	stats.PendingFolderTimers = len(w.folderDebounce)
+	return stats
+}
+
+// MetricType is the kind of value held by a Metric, following the Prometheus counter and gauge types
+type MetricType int
+
+const (
+	CounterMetric MetricType = iota // only ever increases
+	GaugeMetric                     // can go up and down
+)
+
+// Metric is a single value from MetricsSnapshot
+type Metric struct {
+	Name  string // follows the Prometheus conventions, e.g. gobounce_notifications_total
+	Help  string
+	Type  MetricType
+	Value float64
+}
+
+// MetricsSnapshot returns the Stats, along with whether the watcher is running and when it last polled, as metrics
+// which can be translated into a prometheus.Collector or any other metrics library without gobounce depending on it
+func (w *Filewatcher) MetricsSnapshot() []Metric {
+	stats := w.Stats()
+	running := 0.0
+	if w.IsRunning() {
+		running = 1
+	}
+	lastPoll := 0.0
+	if last := w.LastPollTime(); !last.IsZero() {
+		lastPoll = float64(last.UnixNano()) / float64(time.Second)
+	}
+	return []Metric{
+		{"gobounce_watched_folders", "Number of folders being watched", GaugeMetric, float64(stats.WatchedFolders)},
+		{"gobounce_pending_file_timers", "Number of file debounce timers which haven't fired yet", GaugeMetric, float64(stats.PendingFileTimers)},
+		{"gobounce_pending_folder_timers", "Number of folder debounce timers which haven't fired yet", GaugeMetric, float64(stats.PendingFolderTimers)},
+		{"gobounce_events_processed_total", "Events received from the underlying watcher", CounterMetric, float64(stats.EventsProcessed)},
+		{"gobounce_notifications_total", "Notifications published after debouncing", CounterMetric, float64(stats.Notifications)},
+		{"gobounce_dropped_total", "Notifications dropped because the path no longer existed or didn't change", CounterMetric, float64(stats.Dropped)},
+		{"gobounce_dropped_full_total", "Path channel sends dropped because the channel was full", CounterMetric, float64(stats.DroppedFull)},
+		{"gobounce_dropped_events_total", "Events channel sends dropped because the channel was full", CounterMetric, float64(stats.DroppedEvents)},
+		{"gobounce_dropped_errors_total", "Errors dropped because the Error channel was full", CounterMetric, float64(stats.DroppedErrors)},
+		{"gobounce_deduplicated_total", "Notifications suppressed within the dedupe window", CounterMetric, float64(stats.Deduplicated)},
+		{"gobounce_throttled_total", "Notifications dropped for exceeding the notification rate limit", CounterMetric, float64(stats.Throttled)},
+		{"gobounce_running", "Whether the watcher is polling for changes", GaugeMetric, running},
+		{"gobounce_last_poll_timestamp_seconds", "When the underlying watcher was last seen polling. 0 if it hasn't yet", GaugeMetric, lastPoll},
+	}
+}
+
+// PendingFiles returns the sorted paths of the files whose debounce timers haven't fired yet
+func (w *Filewatcher) PendingFiles() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return pendingPaths(w.fileDebounce)
+}
+
+// PendingFolders returns the sorted paths of the folders whose debounce timers haven't fired yet
+func (w *Filewatcher) PendingFolders() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return pendingPaths(w.folderDebounce)
+}
+
+func pendingPaths(debounceMap map[string]*debounceEntry) []string {
+	paths := make([]string, 0, len(debounceMap))
+	for path := range debounceMap {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (w *Filewatcher) Start() {
+	if !w.waitArmed(context.Background()) || !w.startListening() {
+		return
+	}
+
+	w.setRunning(true)
+	w.poll()
+	w.setRunning(false)
+}
+
+// StartContext starts the watcher and blocks until the context is cancelled or the underlying watcher fails to start.
+// In either case the watcher is closed just as if Close had been called. When the context is cancelled, the context's
+// error is returned
+func (w *Filewatcher) StartContext(ctx context.Context) error {
+	if !w.waitArmed(ctx) {
+		w.Close()
+		return ctx.Err()
+	}
+	if !w.startListening() {
+		return ctx.Err()
+	}
+
+	errc := make(chan error, 1)
+	w.setRunning(true)
+	go func() {
+		errc <- w.poll()
+	}()
+
+	select {
+	case err := <-errc:
+		w.setRunning(false)
+		w.Close() // stop the listen goroutine since the underlying watcher will never close its channels
+		return err
+	case <-ctx.Done():
+		w.underlying().Wait() // make sure the underlying watcher is running so that Close actually stops it
+		w.Close()
+		<-errc
+		return ctx.Err()
+	}
+}
+
+// Arm lets a watcher created with Options.StartPaused begin watching once Start or StartContext is called, or
+// straight away if they're already waiting. It has no effect otherwise
+func (w *Filewatcher) Arm() {
+	w.armOnce.Do(func() { close(w.armed) })
+}
+
+// waitArmed blocks until Arm has been called. It returns false if the watcher was closed or the context cancelled first
+func (w *Filewatcher) waitArmed(ctx context.Context) bool {
+	select {
+	case <-w.armed:
+		return true
+	case <-w.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (w *Filewatcher) setRunning(running bool) {
+	w.mutex.Lock()
+	w.running = running
+	w.mutex.Unlock()
+}
+
+// IsRunning returns true if the watcher has been started and is still polling for changes
+func (w *Filewatcher) IsRunning() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.running
+}
+
+// LastPollTime returns when the underlying watcher was last seen polling, either by listing the contents of a root
+// folder or by delivering an event or error. It only advances on each poll while at least one root folder has
+// contents, so compare it against the pollDuration with that in mind
+func (w *Filewatcher) LastPollTime() time.Time {
+	last, _ := w.lastPoll.Load().(time.Time)
+	return last
+}
+
+// PollDuration returns how often the underlying watcher polls for changes, as set by New or SetPollDuration
+func (w *Filewatcher) PollDuration() time.Duration {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.pollDuration
+}
+
+// DebounceDuration returns how long a file or folder must go without changes before it's notified. Unless
+// Options.DebounceDuration was set, this is 2x the PollDuration. DebounceByPattern can override it for some files
+func (w *Filewatcher) DebounceDuration() time.Duration {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.debounceDuration
+}
+
+// startListening starts processing events from the underlying watcher. When NotifyExisting is set, the existing files
+// are published before returning so that they reach FileChanged ahead of any polled changes, which means the caller
+// blocks until the consumer has received them all. It returns false if the watcher was closed in the meantime
+func (w *Filewatcher) startListening() bool {
+	w.wg.Add(1)
+	go w.listen()
+
+	w.mutex.Lock()
+	addErrors := w.addErrors
+	w.addErrors = nil
+	notifyExisting := w.options.NotifyExisting
+	foldersOnly := w.options.FolderEventsOnly || w.options.CollapseToRoot
+	w.mutex.Unlock()
+	if len(addErrors) > 0 {
+		w.wg.Add(1)
+		go func() { // sent separately so that Start doesn't wait for the consumer
+			defer w.wg.Done()
+			for _, err := range addErrors {
+				w.sendError(err)
+			}
+		}()
+	}
+
+	if notifyExisting {
+		paths, notifyChannel := w.existingFiles(), w.FileChanged
+		if foldersOnly { // FileChanged isn't drained in these modes
+			paths, notifyChannel = w.existingFolders(paths), w.FolderChanged
+		}
+		for _, path := range paths {
+			w.mutex.Lock()
+			w.stats.Notifications++
+			w.seq++
+			event := Event{Path: path, Op: Create, IsDir: foldersOnly, Seq: w.seq}
+			w.mutex.Unlock()
+			w.notify(notifyChannel, event)
+		}
+	}
+	select {
+	case <-w.done:
+		return false
+	default:
+		// the folders were listed when they were added, so the first poll catches any change made from here on
+		w.readyOnce.Do(func() { close(w.Ready) })
+		return true
+	}
+}
+
+// existingFolders returns the sorted folders which would be notified for the files with Options.FolderEventsOnly or
+// Options.CollapseToRoot: the folder containing each file, or the root folder containing it
+func (w *Filewatcher) existingFolders(files []string) []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	seen := make(map[string]bool)
+	folders := []string{}
+	for _, file := range files {
+		folder := filepath.Dir(file)
+		if w.options.CollapseToRoot {
+			folder = w.collapsedRoot(file)
+		}
+		if !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// existingFiles returns the sorted list of files currently being watched which pass the include and exclude filters
+func (w *Filewatcher) existingFiles() []string {
+	files := []string{}
+	for path, info := range w.underlying().WatchedFiles() {
+		w.mutex.Lock()
+		included := !info.IsDir() && w.isNotifiedFile(path, info)
+		w.mutex.Unlock()
+		if included {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// listen processes events from the underlying watcher until it is closed. It must keep draining the events until
+// then, otherwise the underlying watcher would block and never finish closing. It also stops once Close is called,
+// which covers an underlying watcher that was never started
+func (w *Filewatcher) listen() {
+	defer w.wg.Done()
+	for {
+		current := w.underlying()
+		select {
+		case <-w.done:
+			return
+		case e := <-current.Events():
+			w.polled()
+			w.debounce(e)
+		case err := <-current.Errors():
+			w.polled()
+			if err == watcher.ErrWatchedFileDeleted {
+				w.reportDeleted()
+				continue
+			}
+			w.sendError(w.watchError(err))
+		case <-current.Closed():
+			if w.underlying() == current {
+				return // closed rather than replaced by SetPollDuration
+			}
+		}
+	}
+}
+
+func (w *Filewatcher) polled() {
+	w.lastPoll.Store(w.clock.Now())
+}
+
+// Close stops the watcher and closes the notification channels. It is safe to call multiple times
+func (w *Filewatcher) Close() {
+	w.CloseErr()
+}
+
+// CloseErr is the same as Close, but returns any error encountered while closing the underlying watcher. Repeated
+// calls return the error from the first call
+func (w *Filewatcher) CloseErr() error {
+	w.closeOnce.Do(func() {
+		w.closeWatcher()
+		close(w.Closed)
+		close(w.done)
+		w.wg.Wait() // make sure nothing is still sending before closing the channels
+		close(w.FileChanged)
+		close(w.FolderChanged)
+		close(w.FileRemoved)
+		close(w.FolderRemoved)
+		close(w.Events)
+		close(w.BatchChanged)
+		close(w.BatchByFolder)
+		close(w.AnyChanged)
+		close(w.Idle)
+		close(w.finished)
+	})
+	w.watcherMutex.Lock()
+	defer w.watcherMutex.Unlock()
+	return w.closeErr
+}
+
+// FlushAndClose stops watching, publishes all pending notifications straight away instead of waiting for their
+// debounce timers and then closes the watcher just like Close. It blocks until the consumer has received the pending
+// notifications, so the final changes aren't lost on shutdown. When paused, the notifications held since Pause are
+// published too
+func (w *Filewatcher) FlushAndClose() error {
+	w.closeWatcher() // stop polling so that no new events arrive while flushing
+
+	w.mutex.Lock()
+	w.paused = false // otherwise fire would hold the flushed notifications again
+	for _, event := range w.held {
+		w.debounceItem(w.debounceMap(event), event)
+	}
+	w.held = nil
+	pending := append(w.takePending(w.fileDebounce), w.takePending(w.folderDebounce)...)
+	w.mutex.Unlock()
+	for _, event := range pending {
+		w.fire(event)
+	}
+
+	w.mutex.Lock()
+	batch := w.batch
+	w.batch, w.batchPaths = nil, nil
+	groupByFolder := w.options.GroupByFolder
+	w.mutex.Unlock()
+	if len(batch) > 0 {
+		w.publishBatch(batch, groupByFolder)
+	}
+	return w.CloseErr()
+}
+
+// takePending cancels the pending timers and returns the events they would have published, sorted by path. The mutex
+// must be held by the caller
+func (w *Filewatcher) takePending(debounceMap map[string]*debounceEntry) []Event {
+	events := []Event{}
+	for path, entry := range debounceMap {
+		if !entry.fired || (w.options.DebounceMode == Both && entry.pending) {
+			events = append(events, entry.event)
+		}
+		w.stopTimer(entry)
+		delete(debounceMap, path)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Path < events[j].Path })
+	return events
+}
+
+// closeWatcher closes the underlying watcher and returns the first error it reported, since FlushAndClose closes it
+// before Close does
+func (w *Filewatcher) closeWatcher() error {
+	w.watcherMutex.Lock()
+	defer w.watcherMutex.Unlock()
+	if err := w.underlying().Close(); err != nil && w.closeErr == nil {
+		w.closeErr = err
+	}
+	return w.closeErr
+}
+
+// Wait blocks until the watcher has been closed and the listen and debounce goroutines have all exited
+func (w *Filewatcher) Wait() {
+	<-w.finished
+}
+
+func (w *Filewatcher) debounce(e watcher.Event) {
+	watcherPath, watcherOldPath := getWatcherPaths(e)
+	path, _ := filepath.Abs(watcherPath)
+
+	w.mutex.Lock() // the options can be replaced by UpdateOptions at any time
+	w.stats.EventsProcessed++
+	w.resetIdle()
+	if _, ok := w.watchignore[filepath.Dir(path)]; ok && w.options.Watchignore && filepath.Base(path) == watchignoreFile {
+		w.loadWatchignore(filepath.Dir(path))
+	}
+	beforeAdd := w.options.BeforeAddFolder
+	if w.expandedParents[path] || w.expandedParents[filepath.Dir(path)] { // the children report their own changes
+		newChild := w.isNewChild(e, path)
+		w.mutex.Unlock()
+		if newChild && beforeAdd != nil && !beforeAdd(path) {
+			w.debugf("not adding new root folder %s since BeforeAddFolder returned false", path)
+			newChild = false
+		}
+		if newChild {
+			w.wg.Add(1)
+			go func() { // added asynchronously since the underlying watcher holds its lock until all events are delivered
+				defer w.wg.Done()
+				if err := w.AddFolder(path); err != nil {
+					w.debugf("unable to add new root folder %s: %v", path, err)
+				}
+			}()
+		}
+		return
+	}
+	if e.Op == watcher.Chmod && w.options.IgnoreChmod {
+		w.mutex.Unlock()
+		return
+	}
+	isDir := e.IsDir() || (w.options.FollowSymlinks && e.Mode()&os.ModeSymlink != 0 && isFolder(path))
+	accepted := w.options.Filter == nil || w.options.Filter(path, e.FileInfo)
+	follow := (e.Op == watcher.Create || e.Op == watcher.Move || e.Op == watcher.Rename) && isDir && accepted && w.shouldFollow(path)
+	included := accepted && (isDir || w.isIncludedFile(path))
+	editorTemp := w.options.IgnoreEditorTemp && !isDir && w.matchesAny(editorTempPatterns, path)
+	renamedFromTemp := w.options.IgnoreEditorTemp && !isDir && watcherOldPath != "" && w.matchesAny(editorTempPatterns, watcherOldPath)
+	appeared := (e.Op == watcher.Create || e.Op == watcher.Move || e.Op == watcher.Rename) && !renamedFromTemp
+	createOnly := w.options.CreateOnly
+	split := w.options.SplitRenames && watcherOldPath != "" && !renamedFromTemp
+	removeOld := split && !createOnly && (isDir || w.isIncludedFile(watcherOldPath))
+	muted := w.isMuted(path)
+	hidden := (isDir && !w.includeHiddenFolders() && isHiddenFolder(path)) || (!isDir && !w.includeHiddenFiles() && isHiddenFile(path))
+	folderWrite := isDir && e.Op == watcher.Write && w.folders[path] && w.reportsThroughChildren(path) // only its children changed
+	w.mutex.Unlock()
+	if path == "" {
+		return
+	}
+
+	if follow && beforeAdd != nil && !beforeAdd(path) {
+		w.debugf("not following %s since BeforeAddFolder returned false", path)
+		follow = false
+	}
+	if follow {
+		w.wg.Add(1)
+		go func() { // added asynchronously since the underlying watcher holds its lock until all events are delivered
+			defer w.wg.Done()
+			if err := w.addWatchFolder(path); err != nil && w.retriesAdd() {
+				w.sendError(&WatchError{Op: "add", Path: path, Err: err})
+			}
+		}()
+	}
+	if isDir && e.Op == watcher.Remove {
+		w.forgetFolder(path)
+	} else if isDir && watcherOldPath != "" {
+		oldPath, _ := filepath.Abs(watcherOldPath)
+		w.forgetFolder(oldPath)
+	}
+	if !included || editorTemp || (createOnly && !appeared) || muted || hidden || folderWrite {
+		return
+	}
+
+	event := Event{Path: path, Op: Op(e.Op), IsDir: isDir}
+	if renamedFromTemp {
+		event.Op = Write // an atomic save which renamed the temp file over the real one
+	} else if watcherOldPath != "" {
+		event.OldPath, _ = filepath.Abs(watcherOldPath)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	events := []Event{}
+	if (isDir && !w.options.FileEventsOnly) || (!isDir && !w.options.FolderEventsOnly) {
+		switch {
+		case removeOld:
+			events = append(events, Event{Path: event.OldPath, Op: Remove, IsDir: isDir}, Event{Path: path, Op: Create, IsDir: isDir})
+		case split:
+			events = append(events, Event{Path: path, Op: Create, IsDir: isDir})
+		default:
+			events = append(events, event)
+		}
+	}
+	dir := filepath.Dir(path)
+	notifyParent := !isDir && (w.folders[dir] || w.options.FolderEventsOnly) // files watched individually through RootFiles only notify for their folder with FolderEventsOnly
+	if isDir && event.Op != Write && w.folders[dir] && (w.options.IgnoreTransientFiles || w.reportsThroughChildren(dir)) {
+		notifyParent = true // record the subfolder as a change to its parent, whose modification time changes along with it anyway
+	}
+	if notifyParent && !w.options.FileEventsOnly {
+		events = append(events, Event{Path: dir, Op: Write, IsDir: true})
+	}
+	if w.options.CollapseToRoot {
+		events = []Event{{Path: w.collapsedRoot(path), Op: Write, IsDir: true}}
+	}
+	if w.paused {
+		w.pausedChanges = true
+		if w.options.BufferWhilePaused {
+			w.held = append(w.held, events...)
+		}
+		return
+	}
+	for _, event := range events {
+		w.debounceItem(w.debounceMap(event), event)
+	}
+	if entry := w.folderDebounce[dir]; notifyParent && entry != nil && w.options.IgnoreTransientFiles {
+		if entry.causes == nil {
+			entry.causes = make(map[string]bool)
+		}
+		if _, ok := entry.causes[path]; !ok {
+			entry.causes[path] = event.Op == Create
+		}
+	}
+}
+
+// reportsThroughChildren returns true if the changes to the watched folder are only reported through the events for
+// its files and subfolders, rather than when its modification time changes. That's the case with ExcludePatterns,
+// since creating or removing an excluded file changes the folder's modification time without any event for the file.
+// The mutex must be held by the caller
+func (w *Filewatcher) reportsThroughChildren(folder string) bool {
+	options, _ := w.optionsFor(folder)
+	return len(options.ExcludePatterns) > 0
+}
+
+// collapsedRoot returns the root folder which Options.CollapseToRoot notifies for the path. The mutex must be held by
+// the caller
+func (w *Filewatcher) collapsedRoot(path string) string {
+	for _, file := range w.options.RootFiles {
+		if absFile, _ := filepath.Abs(file); absFile == path {
+			return filepath.Dir(absFile) // a root file is collapsed into its folder
+		}
+	}
+	root, _ := w.closestRoot(path) // not checked with isFolder, since the root may have just been deleted
+	return root
+}
+
+// watchError adds the path and operation to an error from the underlying watcher where they can be determined
+func (w *Filewatcher) watchError(err error) error {
+	var pathErr *os.PathError
+	switch {
+	case errors.As(err, &pathErr):
+		return &WatchError{Op: pathErr.Op, Path: pathErr.Path, Err: pathErr.Err}
+	default:
+		return err
+	}
+}
+
+// reportDeleted publishes an error for each deleted folder and root file
+func (w *Filewatcher) reportDeleted() {
+	for _, err := range w.deletedErrors() {
+		w.sendError(err)
+	}
+}
+
+// deletedErrors stops watching the folders and root files which no longer exist and returns an error for each of
+// them. The underlying watcher reports every deleted folder separately but without its path, so only the topmost
+// deleted folder is reported and the reports which follow for its subfolders find nothing left to return. A deleted
+// root folder is reported with ErrRootFolderDeleted and notified as removed, since its parent folder isn't watched
+func (w *Filewatcher) deletedErrors() []error {
+	w.mutex.Lock()
+	roots := make(map[string]bool)
+	for _, root := range w.roots() {
+		absRoot, _ := filepath.Abs(root.Path)
+		roots[absRoot] = true
+	}
+	w.mutex.Unlock()
+
+	errs := []error{}
+	reported := ""
+	for _, folder := range w.forgetDeletedFolders() { // parents come first
+		if reported != "" && isSubpath(folder, reported) {
+			continue
+		}
+		reported = folder
+		if !roots[folder] {
+			errs = append(errs, &WatchError{Op: "watch", Path: folder, Err: watcher.ErrWatchedFileDeleted})
+			continue
+		}
+		w.debugf("stopped watching deleted root folder %s", folder)
+		errs = append(errs, &WatchError{Op: "watch", Path: folder, Err: ErrRootFolderDeleted})
+		w.mutex.Lock()
+		w.debounceItem(w.folderDebounce, Event{Path: folder, Op: Remove, IsDir: true})
+		w.mutex.Unlock()
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	rootFiles := []string{}
+	for _, file := range w.options.RootFiles {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			absFile, _ := filepath.Abs(file)
+			errs = append(errs, &WatchError{Op: "watch", Path: absFile, Err: watcher.ErrWatchedFileDeleted})
+			continue
+		}
+		rootFiles = append(rootFiles, file)
+	}
+	w.options.RootFiles = rootFiles
+	return errs
+}
+
+// sendError publishes the error on the Error channel unless the watcher is closed first. With Options.DropErrors, the
+// error is dropped instead of waiting when the channel is full
+func (w *Filewatcher) sendError(err error) {
+	w.mutex.Lock()
+	dropErrors := w.options.DropErrors
+	w.mutex.Unlock()
+	if dropErrors {
+		select {
+		case w.Error <- err:
+		case <-w.done:
+		default:
+			w.debugf("dropping error since the Error channel is full: %v", err)
+			w.mutex.Lock()
+			w.stats.DroppedErrors++
+			w.mutex.Unlock()
+		}
+		return
+	}
+	select {
+	case w.Error <- err:
+	case <-w.done:
+	}
+}
+
+// forgetDeletedFolders forgets any watched folders which no longer exist and returns them. The underlying watcher stops watching a
+// deleted folder itself before the next poll, reporting it with ErrWatchedFileDeleted but without its path
+func (w *Filewatcher) forgetDeletedFolders() []string {
+	w.mutex.Lock()
+	folders := make([]string, 0, len(w.folders))
+	for folder := range w.folders {
+		folders = append(folders, folder)
+	}
+	w.mutex.Unlock()
+
+	sort.Strings(folders) // parents first so their subfolders are forgotten along with them
+	deleted := []string{}
+	for _, folder := range folders {
+		if _, err := os.Stat(folder); os.IsNotExist(err) {
+			w.forgetFolder(folder)
+			deleted = append(deleted, folder)
+		}
+	}
+	return deleted
+}
+
+// forgetFolder stops watching a folder, along with its subfolders, which no longer exists and cancels any pending
+// notifications for paths within it so that dead watches don't accumulate
+func (w *Filewatcher) forgetFolder(folder string) {
+	w.mutex.Lock()
+	if !w.folders[folder] {
+		w.mutex.Unlock()
+		return
+	}
+	folders := w.unwatchFolder(folder)
+	w.mutex.Unlock()
+	w.debugf("stopped watching deleted folder %s", folder)
+
+	w.wg.Add(1)
+	go func() { // removed asynchronously since the underlying watcher holds its lock until all events are delivered
+		defer w.wg.Done()
+		w.removeWatchFolders(folders)
+	}()
+}
+
+func (w *Filewatcher) debounceMap(event Event) map[string]*debounceEntry {
+	if event.IsDir {
+		return w.folderDebounce
+	}
+	return w.fileDebounce
+}
+
+// Mute stops the notifications for the path, and for everything below it when it's a folder, until Unmute is called.
+// Events received for it in the meantime are discarded, as are any of its pending notifications which fire. Unlike
+// Pause, the rest of the tree keeps notifying
+func (w *Filewatcher) Mute(path string) {
+	absPath, _ := filepath.Abs(path)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.muted == nil {
+		w.muted = make(map[string]bool)
+	}
+	w.muted[absPath] = true
+}
+
+// Unmute restarts the notifications for a path muted with Mute
+func (w *Filewatcher) Unmute(path string) {
+	absPath, _ := filepath.Abs(path)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.muted, absPath)
+}
+
+// isMuted returns true if the path is within a muted path. The mutex must be held
+func (w *Filewatcher) isMuted(path string) bool {
+	for muted := range w.muted {
+		if isSubpath(path, muted) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause stops all notifications until Resume is called. Events received while paused are discarded unless
+// BufferWhilePaused is set, and any debounce timers which fire while paused are held until Resume
+func (w *Filewatcher) Pause() {
+	w.mutex.Lock()
+	w.paused = true
+	w.mutex.Unlock()
+}
+
+// Resume restarts notifications after Pause. Held and buffered events are debounced again from scratch. When
+// NotifyOnResume is set and events were discarded while paused, each root folder is published on FolderChanged
+func (w *Filewatcher) Resume() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.paused {
+		return
+	}
+	w.paused = false
+	for _, event := range w.held {
+		w.debounceItem(w.debounceMap(event), event)
+	}
+	w.held = nil
+
+	discarded := w.pausedChanges && !w.options.BufferWhilePaused
+	w.pausedChanges = false
+	if !discarded || !w.options.NotifyOnResume {
+		return
+	}
+	select {
+	case <-w.done:
+		return // closed, so there's nobody to notify
+	default:
+	}
+	for _, root := range w.roots() {
+		absRoot, _ := filepath.Abs(root.Path)
+		w.seq++
+		event := Event{Path: absRoot, Op: Write, IsDir: true, Seq: w.seq}
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.notify(w.FolderChanged, event)
+		}()
+	}
+}
+
+// shouldFollow returns true if the newly created folder should be added to the watch list
+func (w *Filewatcher) shouldFollow(path string) bool {
+	options, _ := w.optionsFor(path)
+	if !options.FollowNewFolders || w.isExcludedFolder(path) || w.isWatchignored(path) || (!w.includeHiddenFolders() && isHiddenFolder(path)) {
+		return false
+	}
+	if options.FollowNewFoldersPattern != "" {
+		name := filepath.Base(path)
+		if options.CaseInsensitive {
+			name = strings.ToLower(name)
+		}
+		if match, _ := filepath.Match(options.FollowNewFoldersPattern, name); !match {
+			return false
+		}
+	}
+	if w.options.FollowSymlinks && w.isSymlinkIntoRoots(path) {
+		return false // the target is already watched, or is a loop back up the tree
+	}
+	return options.MaxDepth == 0 || !w.isTooDeep(path, w.rootDepth(path))
+}
+
+// isSymlinkIntoRoots returns true if the path is a symlink to a folder within one of the root folders
+func (w *Filewatcher) isSymlinkIntoRoots(path string) bool {
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil || realPath == path {
+		return false
+	}
+	for _, root := range w.roots() {
+		absRoot, _ := filepath.Abs(root.Path)
+		if realRoot, err := filepath.EvalSymlinks(absRoot); err == nil && isSubpath(realPath, realRoot) {
+			return true
+		}
+	}
+	return false
+}
+
+func isFolder(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+func (w *Filewatcher) debounceItem(debounceMap map[string]*debounceEntry, event Event) {
+	if event.IsDir && w.options.CoalesceFolders && w.coalesceFolder(debounceMap, event.Path) {
+		w.debugf("debounce suppressed for %s since a subfolder is pending", event.Path)
+		return
+	}
+
+	entry, ok := debounceMap[event.Path]
+	if !ok {
+		entry = &debounceEntry{event: event, debounceMap: debounceMap, index: -1, first: w.clock.Now(), created: event.Op == Create}
+		debounceMap[event.Path] = entry
+		w.startTimer(entry, w.debounceFor(event))
+		w.debugf("debounce timer created for %s", event.Path)
+		if w.options.DebounceMode != TrailingEdge {
+			entry.fired = true
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				w.publish(event)
+			}()
+		}
+	} else {
+		if entry.fired && !entry.pending {
+			entry.event = event // the earlier events were already published on the leading edge
+		} else {
+			entry.event = mergeEvents(entry.event, event)
+		}
+		entry.pending = entry.fired
+		w.startTimer(entry, w.resetDuration(entry, w.debounceFor(event)))
+		w.debugf("debounce timer reset for %s", event.Path)
+	}
+}
+
+// debounceFor returns the debounce duration for the event, taking DebounceByPattern into account for files. The
+// mutex must be held by the caller
+func (w *Filewatcher) debounceFor(event Event) time.Duration {
+	if event.IsDir || len(w.options.DebounceByPattern) == 0 {
+		return w.debounceDuration
+	}
+	duration, matched := w.debounceDuration, false
+	for pattern, patternDuration := range w.options.DebounceByPattern {
+		if w.matchesAny([]string{pattern}, event.Path) && (!matched || patternDuration > duration) {
+			duration, matched = patternDuration, true
+		}
+	}
+	return duration
+}
+
+// resetDuration returns how long to wait before firing a reset timer, shortened so it fires no later than the
+// MaxDebounceDuration after the first event
+func (w *Filewatcher) resetDuration(entry *debounceEntry, duration time.Duration) time.Duration {
+	if w.options.MaxDebounceDuration == 0 {
+		return duration
+	}
+	remaining := w.options.MaxDebounceDuration - w.clock.Now().Sub(entry.first)
+	if remaining < 0 {
+		return 0
+	}
+	if remaining < duration {
+		return remaining
+	}
+	return duration
+}
+
+// coalesceFolder cancels any pending timers for ancestors of the folder and returns true if the folder itself should
+// be suppressed because one of its subfolders is already pending. The mutex must be held by the caller
+func (w *Filewatcher) coalesceFolder(debounceMap map[string]*debounceEntry, folder string) bool {
+	for path, entry := range debounceMap {
+		if path == folder {
+			continue
+		}
+		if isSubpath(path, folder) {
+			return true
+		}
+		if isSubpath(folder, path) {
+			w.stopTimer(entry)
+			delete(debounceMap, path)
+		}
+	}
+	return false
+}
+
+// mergeEvents combines a pending event with a newly received one for the same path. The latest operation wins
+// except that writes to a newly created item are still reported as a Create
+func mergeEvents(pending, next Event) Event {
+	if pending.Op == Create && (next.Op == Write || next.Op == Chmod) {
+		next.Op = Create
+	}
+	return next
+}
+
+// resetIdle restarts the wait for Options.IdleTimeout after an event. The mutex must be held by the caller
+func (w *Filewatcher) resetIdle() {
+	if w.options.IdleTimeout <= 0 {
+		return
+	}
+	w.lastEvent = w.clock.Now()
+	if w.idleTimer == nil {
+		w.idleTimer = w.clock.NewTimer(w.options.IdleTimeout)
+		w.wg.Add(1)
+		go w.waitIdle(w.idleTimer)
+		return
+	}
+	w.idleTimer.Reset(w.options.IdleTimeout)
+}
+
+// waitIdle signals on the Idle channel each time the idle timer fires, until the watcher is closed. The signal isn't
+// repeated while the consumer hasn't received the previous one
+func (w *Filewatcher) waitIdle(timer Timer) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-timer.C():
+		case <-w.done:
+			timer.Stop()
+			return
+		}
+		w.mutex.Lock()
+		idle := w.options.IdleTimeout > 0 && !w.clock.Now().Before(w.lastEvent.Add(w.options.IdleTimeout))
+		w.mutex.Unlock()
+		if !idle {
+			continue // an event reset the timer after it had already fired
+		}
+		w.debugf("no events received for %v", w.options.IdleTimeout)
+		select {
+		case w.Idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// timerHeap orders the pending debounce entries by deadline
+type timerHeap []*debounceEntry
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	entry := x.(*debounceEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// startTimer sets the entry's debounce timer to fire after the duration, replacing any earlier deadline. A single
+// goroutine services the timers of all entries, so that bulk changes don't start one goroutine per path. The mutex
+// must be held by the caller
+func (w *Filewatcher) startTimer(entry *debounceEntry, duration time.Duration) {
+	entry.deadline = w.clock.Now().Add(duration)
+	if entry.index < 0 {
+		heap.Push(&w.timers, entry)
+	} else {
+		heap.Fix(&w.timers, entry.index)
+	}
+	if w.timer == nil {
+		w.timer = w.clock.NewTimer(duration)
+		w.wg.Add(1)
+		go w.runTimers(w.timer)
+	} else if w.timers[0] == entry {
+		w.timer.Reset(duration)
+	}
+}
+
+// stopTimer cancels the entry's debounce timer. The timer may still wake runTimers, which finds nothing due and waits
+// for the next deadline instead. The mutex must be held by the caller
+func (w *Filewatcher) stopTimer(entry *debounceEntry) {
+	if entry.index >= 0 {
+		heap.Remove(&w.timers, entry.index)
+	}
+}
+
+// runTimers queues each entry to be settled once its deadline passes, until the watcher is closed. The entries are
+// removed from their debounce maps straight away, but settled by up to MaxConcurrency settleQueued goroutines since
+// publishing waits for the consumer
+func (w *Filewatcher) runTimers(timer Timer) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-timer.C():
+		case <-w.done:
+			timer.Stop()
+			return
+		}
+
+		w.mutex.Lock()
+		now := w.clock.Now()
+		for len(w.timers) > 0 && !w.timers[0].deadline.After(now) {
+			entry := heap.Pop(&w.timers).(*debounceEntry)
+			delete(entry.debounceMap, entry.event.Path)
+			w.settling = append(w.settling, entry)
+		}
+		for n := len(w.settling); w.settlers < w.options.MaxConcurrency && n > 0; n-- {
+			w.settlers++
+			w.wg.Add(1)
+			go w.settleQueued()
+		}
+		if len(w.timers) > 0 {
+			timer.Reset(w.timers[0].deadline.Sub(now))
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// settleQueued settles the queued entries one at a time until the queue is empty
+func (w *Filewatcher) settleQueued() {
+	defer w.wg.Done()
+	for {
+		w.mutex.Lock()
+		if len(w.settling) == 0 {
+			w.settlers--
+			w.mutex.Unlock()
+			return
+		}
+		entry := w.settling[0]
+		w.settling[0] = nil
+		w.settling = w.settling[1:]
+		w.mutex.Unlock()
+		w.settle(entry)
+	}
+}
+
+// settle publishes the entry's event once its debounce timer has fired, unless it was already published on the leading
+// edge or is dropped by one of the options
+func (w *Filewatcher) settle(entry *debounceEntry) {
+	w.mutex.Lock()
+	event := entry.event
+	suppressed := entry.fired && (w.options.DebounceMode == LeadingEdge || !entry.pending)
+	stabilityDelay := w.options.StabilityDelay
+	ignoreTransient := w.options.IgnoreTransientFiles
+	w.mutex.Unlock()
+	if suppressed {
+		w.debugf("debounce timer settled for %s after notifying on the leading edge", event.Path)
+		return
+	}
+	if ignoreTransient && isTransient(entry) {
+		w.debugf("dropping %s event for %s since only transient files changed", event.Op, event.Path)
+		w.mutex.Lock()
+		w.stats.Dropped++
+		w.mutex.Unlock()
+		return
+	}
+	w.debugf("debounce timer fired for %s", event.Path)
+	if stabilityDelay > 0 && !event.IsDir && event.Op != Remove && !w.waitStable(event.Path, stabilityDelay) {
+		return
+	}
+	w.publish(event)
+}
+
+// publish fires the event unless its content is unchanged with Options.SkipUnchangedContent or it's dropped by
+// Options.MaxNotificationsPerSecond, on both the leading and trailing edges
+func (w *Filewatcher) publish(event Event) {
+	unchanged, hash := w.isUnchangedContent(event)
+	if unchanged {
+		w.debugf("dropping %s event for %s since its content is unchanged", event.Op, event.Path)
+		w.mutex.Lock()
+		w.stats.Dropped++
+		w.mutex.Unlock()
+		return
+	}
+	if !w.throttle(event) {
+		return
+	}
+	w.fireContent(event, hash)
+}
+
+// contentHashLimit is the maximum number of file hashes kept for Options.SkipUnchangedContent
+const contentHashLimit = 10000
+
+// isUnchangedContent returns true if the file's content hashes the same as when it was last notified. Otherwise it
+// returns the hash, which is recorded by fireContent once the event is published, or nil if there's nothing to record
+func (w *Filewatcher) isUnchangedContent(event Event) (bool, *[sha256.Size]byte) {
+	w.mutex.Lock()
+	enabled := w.options.SkipUnchangedContent
+	w.mutex.Unlock()
+	if !enabled || event.IsDir {
+		return false, nil
+	}
+	hash, err := hashFile(event.Path)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	previous, known := w.contentHashes[event.Path]
+	if err != nil || event.Op == Remove {
+		delete(w.contentHashes, event.Path) // left in hashOrder, where evicting it later does no harm
+		return false, nil
+	}
+	if known && previous == hash && (event.Op == Write || event.Op == Chmod) {
+		return true, nil
+	}
+	return false, &hash
+}
+
+// recordHash remembers the hash of the file's content, evicting the oldest hash once contentHashLimit files are known.
+// The mutex must be held by the caller
+func (w *Filewatcher) recordHash(path string, hash [sha256.Size]byte) {
+	if _, known := w.contentHashes[path]; !known {
+		if len(w.hashOrder) >= contentHashLimit {
+			delete(w.contentHashes, w.hashOrder[0])
+			w.hashOrder = w.hashOrder[1:]
+		}
+		w.hashOrder = append(w.hashOrder, path)
+	}
+	w.contentHashes[path] = hash
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	file, err := os.Open(path)
+	if err != nil {
+		return hash, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return hash, err
+	}
+	copy(hash[:], hasher.Sum(nil))
+	return hash, nil
+}
+
+// throttle takes a token from the bucket which enforces MaxNotificationsPerSecond, waiting for one to be refilled
+// unless DropThrottled is set. It returns false if the notification should be dropped or the watcher was closed first
+func (w *Filewatcher) throttle(event Event) bool {
+	for {
+		w.mutex.Lock()
+		rate := float64(w.options.MaxNotificationsPerSecond)
+		if rate <= 0 {
+			w.mutex.Unlock()
+			return true
+		}
+		now := w.clock.Now()
+		if w.tokensAt.IsZero() {
+			w.tokens = rate
+		} else {
+			w.tokens = math.Min(rate, w.tokens+now.Sub(w.tokensAt).Seconds()*rate)
+		}
+		w.tokensAt = now
+		if w.tokens >= 1 {
+			w.tokens--
+			w.mutex.Unlock()
+			return true
+		}
+		if w.options.DropThrottled {
+			w.stats.Throttled++
+			w.mutex.Unlock()
+			w.debugf("dropping %s event for %s since the notification rate limit was reached", event.Op, event.Path)
+			return false
+		}
+		wait := time.Duration(math.Ceil((1 - w.tokens) / rate * float64(time.Second)))
+		w.mutex.Unlock()
+
+		timer := w.clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-w.done:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// isTransient returns true if the entry is for a file which was created and deleted again within the window, or for a
+// folder whose only changes were to such files. The entry must already have been removed from its debounce map
+func isTransient(entry *debounceEntry) bool {
+	if !entry.event.IsDir {
+		return entry.created && !exists(entry.event.Path)
+	}
+	if entry.event.Op != Write || len(entry.causes) == 0 {
+		return false // the folder itself changed, or it's unknown what changed within it
+	}
+	for path, created := range entry.causes {
+		if !created || exists(path) {
+			return false
+		}
+	}
+	return true
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
+}
+
+// waitStable waits until the file's size and modification time haven't changed for the delay. It returns false if the
+// watcher was closed first. A file which can no longer be read is left for fire to handle
+func (w *Filewatcher) waitStable(path string, delay time.Duration) bool {
+	last, err := os.Stat(path)
+	for err == nil {
+		timer := w.clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-w.done:
+			timer.Stop()
+			return false
+		}
+		info, statErr := os.Stat(path)
+		if statErr == nil && info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+			return true
+		}
+		w.debugf("waiting for %s to stop changing", path)
+		last, err = info, statErr
+	}
+	return true
+}
+
+// fire publishes the debounced event unless its path has since vanished. Events firing while paused are held until
+// Resume
+func (w *Filewatcher) fire(event Event) {
+	w.fireContent(event, nil)
+}
+
+// fireContent is the same as fire, but also records the hash of the file's content with Options.SkipUnchangedContent
+// once the event is published, so that a held or dropped event doesn't count as notified. hash may be nil
+func (w *Filewatcher) fireContent(event Event, hash *[sha256.Size]byte) {
+	w.mutex.Lock()
+	if w.paused {
+		w.held = append(w.held, event)
+		w.mutex.Unlock()
+		return
+	}
+	muted := w.isMuted(event.Path)
+	w.mutex.Unlock()
+	if muted {
+		w.debugf("dropping %s event for %s since it's muted", event.Op, event.Path)
+		return
+	}
+
+	info, err := os.Stat(event.Path)
+	switch {
+	case os.IsNotExist(err) && event.Op != Remove:
+		w.debugf("dropping %s event for %s since it no longer exists", event.Op, event.Path)
+		w.mutex.Lock()
+		w.stats.Dropped++
+		w.mutex.Unlock()
+		return // file vanished without a remove event (e.g. a transient rename during an atomic save), so ignore
+	case err != nil && !os.IsNotExist(err):
+		w.debugf("dropping %s event for %s since it can't be read: %v", event.Op, event.Path, err)
+		w.sendError(w.watchError(err))
+		return // publish the error instead since the consumer couldn't use the path anyway
+	case err == nil && event.Op == Remove:
+		event.Op = Create // file was removed and then recreated within the debounce window
+	}
+	if err == nil {
+		event.Size, event.ModTime = info.Size(), info.ModTime()
+	}
+	w.mutex.Lock()
+	if w.isDuplicate(event) {
+		w.stats.Deduplicated++
+		w.mutex.Unlock()
+		w.debugf("dropping %s event for %s since it was notified within the dedupe window", event.Op, event.Path)
+		return
+	}
+	w.stats.Notifications++
+	w.seq++
+	event.Seq = w.seq
+	if hash != nil {
+		w.recordHash(event.Path, *hash)
+	}
+	if w.options.BatchWindow > 0 && !event.IsDir {
+		w.addToBatch(event.Path)
+	}
+	notifyChannel := w.notifyChannel(event)
+	w.mutex.Unlock()
+	w.notify(notifyChannel, event)
+}
+
+// isDuplicate returns true if the event repeats one notified within the DedupeWindow. Otherwise it records the event,
+// forgetting any which have fallen outside the window. The mutex must be held
+func (w *Filewatcher) isDuplicate(event Event) bool {
+	if w.options.DedupeWindow <= 0 {
+		return false
+	}
+	now := w.clock.Now()
+	for path, last := range w.lastNotified {
+		if now.Sub(last.at) >= w.options.DedupeWindow {
+			delete(w.lastNotified, path)
+		}
+	}
+	if last, ok := w.lastNotified[event.Path]; ok && last.op == event.Op {
+		return true
+	}
+	w.lastNotified[event.Path] = notified{op: event.Op, at: now}
+	return false
+}
+
+// addToBatch adds the path to the current batch, starting a new batch if needed. The mutex must be held by the caller
+func (w *Filewatcher) addToBatch(path string) {
+	if w.batchPaths == nil {
+		w.batchPaths = make(map[string]bool)
+		w.wg.Add(1)
+		go w.waitBatch(w.clock.NewTimer(w.options.BatchWindow))
+	}
+	if !w.batchPaths[path] {
+		w.batchPaths[path] = true
+		w.batch = append(w.batch, w.publishedPath(path))
+	}
+}
+
+func (w *Filewatcher) waitBatch(timer Timer) {
+	defer w.wg.Done()
+	select {
+	case <-timer.C():
+	case <-w.done:
+		timer.Stop()
+		return
+	}
+
+	w.mutex.Lock()
+	batch := w.batch
+	w.batch = nil
+	w.batchPaths = nil
+	groupByFolder := w.options.GroupByFolder
+	w.mutex.Unlock()
+	if len(batch) == 0 {
+		return // already flushed by FlushAndClose
+	}
+	w.publishBatch(batch, groupByFolder)
+}
+
+// publishBatch sends the batch on BatchChanged, or on BatchByFolder grouped by the folder containing each file, unless
+// the watcher is closed first
+func (w *Filewatcher) publishBatch(batch []string, groupByFolder bool) {
+	if !groupByFolder {
+		select {
+		case w.BatchChanged <- batch:
+		case <-w.done:
+		}
+		return
+	}
+	grouped := make(map[string][]string)
+	for _, path := range batch {
+		folder := filepath.Dir(path)
+		grouped[folder] = append(grouped[folder], path)
+	}
+	select {
+	case w.BatchByFolder <- grouped:
+	case <-w.done:
+	}
+}
+
+// OnFileChanged registers a callback which is called instead of publishing on the FileChanged and Events channels.
+// Callbacks are called from the debounce goroutines, so they may run concurrently with each other and must do their
+// own locking if needed
+func (w *Filewatcher) OnFileChanged(callback func(path string)) {
+	w.mutex.Lock()
+	w.onFileChanged = callback
+	w.mutex.Unlock()
+}
+
+// OnFolderChanged registers a callback which is called instead of publishing on the FolderChanged and Events
+// channels. Like OnFileChanged, the callback may run concurrently with other callbacks
+func (w *Filewatcher) OnFolderChanged(callback func(path string)) {
+	w.mutex.Lock()
+	w.onFolderChanged = callback
+	w.mutex.Unlock()
+}
+
+// notifyCallback returns the callback registered for the event, if any. The mutex must be held by the caller
+func (w *Filewatcher) notifyCallback(event Event) func(path string) {
+	switch {
+	case event.Op == Remove:
+		return nil
+	case event.IsDir:
+		return w.onFolderChanged
+	default:
+		return w.onFileChanged
+	}
+}
+
+// notifyOrDrop publishes the event without blocking, dropping it from any channel which is full
+func (w *Filewatcher) notifyOrDrop(event Event, eventChannel chan Event, pathChannels ...chan string) {
+	var droppedPaths uint64
+	var droppedEvent bool
+	for _, pathChannel := range pathChannels {
+		if pathChannel == nil {
+			continue
+		}
+		select {
+		case pathChannel <- event.Path:
+		default:
+			droppedPaths++
+		}
+	}
+	if eventChannel != nil {
+		select {
+		case eventChannel <- event:
+		default:
+			droppedEvent = true
+		}
+	}
+	if droppedPaths == 0 && !droppedEvent {
+		return
+	}
+	w.debugf("dropping %s event for %s since the channel is full", event.Op, event.Path)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stats.DroppedFull += droppedPaths
+	if droppedEvent {
+		w.stats.DroppedEvents++
+	}
+}
+
+// RootFor returns the absolute path of the root folder containing the path, or the root file when the path is one.
+// When roots are nested, the innermost one wins. It returns an empty string if the path isn't below any root
+func (w *Filewatcher) RootFor(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.rootFor(absPath)
+}
+
+// rootFor returns the root for the absolute path. The mutex must be held
+func (w *Filewatcher) rootFor(path string) string {
+	for _, file := range w.options.RootFiles {
+		if absFile, _ := filepath.Abs(file); absFile == path {
+			return absFile
+		}
+	}
+	root, _ := w.closestRoot(path)
+	return root
+}
+
+// publishedPath converts the absolute path into the form notifications are published in
+func (w *Filewatcher) publishedPath(path string) string {
+	if w.options.RelativePaths {
+		if root, depth := w.closestRoot(path); depth != -1 {
+			path, _ = filepath.Rel(root, path)
+		}
+	}
+	if w.options.ForwardSlashes {
+		path = filepath.ToSlash(path)
+	}
+	return path
+}
+
+func (w *Filewatcher) notifyChannel(event Event) chan string {
+	switch {
+	case event.Op == Remove && !w.options.NotifyRemoved:
+		return nil
+	case event.IsDir && event.Op == Remove:
+		return w.FolderRemoved
+	case event.IsDir:
+		return w.FolderChanged
+	case event.Op == Remove:
+		return w.FileRemoved
+	default:
+		return w.FileChanged
+	}
+}
+
+// notify publishes the event on the path channel and, when enabled, the AnyChanged and Events channels. The sends are
+// done independently so that a consumer reading only one of the channels doesn't prevent delivery to the others
+func (w *Filewatcher) notify(notifyChannel chan string, event Event) {
+	w.mutex.Lock()
+	event.Root = w.rootFor(event.Path)
+	if w.options.ForwardSlashes {
+		event.Root = filepath.ToSlash(event.Root)
+	}
+	event.Path = w.publishedPath(event.Path)
+	if event.OldPath != "" {
+		event.OldPath = w.publishedPath(event.OldPath)
+	}
+	callback := w.notifyCallback(event)
+	var eventChannel chan Event
+	if w.options.PublishEvents {
+		eventChannel = w.Events
+	}
+	var anyChannel chan string
+	if w.options.NotifyAny && (notifyChannel == w.FileChanged || notifyChannel == w.FolderChanged) {
+		anyChannel = w.AnyChanged
+	}
+	dropOnFull := w.options.DropOnFull
+	w.mutex.Unlock()
+	if callback != nil {
+		callback(event.Path)
+		return
+	}
+
+	if dropOnFull {
+		w.notifyOrDrop(event, eventChannel, notifyChannel, anyChannel)
+		return
+	}
+
+	pathChannel := notifyChannel
+	for pathChannel != nil || anyChannel != nil || eventChannel != nil {
+		select {
+		case pathChannel <- event.Path:
+			pathChannel = nil
+		case anyChannel <- event.Path:
+			anyChannel = nil
+		case eventChannel <- event:
+			eventChannel = nil
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *Filewatcher) debugf(format string, args ...interface{}) {
+	if w.logger != nil {
+		w.logger.Debugf(format, args...)
+	}
+}
+
+// getWatcherPaths returns the path of the event along with the previous path for Rename and Move events
+func getWatcherPaths(e watcher.Event) (string, string) {
+	if e.Op != watcher.Rename && e.Op != watcher.Move {
+		return e.Path, ""
+	}
+	if e.OldPath != "" {
+		return e.Path, e.OldPath
+	}
+	return splitRenamePath(e.Path)
+}
+
+// splitRenamePath splits a path in the "fromPath -> toPath" format used by older versions of
+// https://github.com/radovskyb/watcher for Rename and Move events. Since the paths themselves could contain the
+// separator, the split where the destination exists is preferred, falling back to the first separator
+func splitRenamePath(path string) (string, string) {
+	const separator = " -> "
+	first := strings.Index(path, separator)
+	if first == -1 {
+		return path, ""
+	}
+	for i := first; i != -1; {
+		if _, err := os.Stat(path[i+len(separator):]); err == nil {
+			return path[i+len(separator):], path[:i]
+		}
+		next := strings.Index(path[i+1:], separator)
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
+	return path[first+len(separator):], path[:first]
 }
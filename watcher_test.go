@@ -1,12 +1,19 @@
 package gobounce
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/radovskyb/watcher"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -27,11 +34,401 @@ func TestGetWatchFolders(t *testing.T) {
 	w = &Filewatcher{options: Options{RootFolders: []string{"/path"}, ExcludeSubdirs: true}}
 	folders, _ = w.getWatchFolders()
 	assert.Equal(t, []string{"/path"}, folders)
+
+	w = &Filewatcher{options: Options{RootFolders: []string{filepath.Join("testdata", "test")}}}
+	_, err = w.getWatchFolders()
+	assert.EqualError(t, err, "root folder "+filepath.Join("testdata", "test")+" is not a directory")
+
+	w.options.ExcludeSubdirs = true
+	_, err = w.getWatchFolders()
+	assert.Error(t, err)
+
+	w = &Filewatcher{options: Options{Roots: []RootFolder{
+		{Path: filepath.Join("testdata", "dir"), Recursive: false},
+		{Path: filepath.Join("testdata", "dir", "exclude"), Recursive: true},
+	}}}
+	folders, _ = w.getWatchFolders()
+	assert.Equal(t, []string{
+		filepath.Join("testdata", "dir"),
+		filepath.Join("testdata", "dir", "exclude"),
+		filepath.Join("testdata", "dir", "exclude", "othersubdir"),
+	}, folders)
+}
+
+func TestGetWatchFoldersSymlinks(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "b"), 0755))
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "b", "loop")))
+	require.NoError(t, os.Symlink(other, filepath.Join(root, "link")))
+
+	w := &Filewatcher{options: Options{RootFolders: []string{root}}}
+	folders, err := w.getWatchFolders()
+	require.NoError(t, err)
+	assert.Equal(t, []string{root, filepath.Join(root, "a"), filepath.Join(root, "b")}, folders)
+
+	w.options.FollowSymlinks = true
+	folders, err = w.getWatchFolders()
+	require.NoError(t, err)
+	assert.Equal(t, []string{root, filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "link")}, folders)
 }
 
 func TestNew(t *testing.T) {
 	_, err := New(Options{RootFolders: []string{"//bogusPath"}}, time.Millisecond)
 	assert.Error(t, err)
+
+	_, err = New(Options{RootFolders: []string{"testdata"}, FolderExclusionPatterns: []string{"("}}, time.Millisecond)
+	assert.Error(t, err)
+
+	_, err = New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Millisecond}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Second}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, w.debounceDuration)
+
+	w, err = New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Millisecond, w.debounceDuration)
+
+	w, err = New(Options{RootFolders: []string{"testdata"}, MaxConcurrency: 3}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 3, cap(w.FileChanged))
+	assert.Equal(t, 3, cap(w.Error))
+
+	w, err = New(Options{RootFolders: []string{"testdata"}, MaxConcurrency: 3, ChannelBufferSize: 10}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 10, cap(w.FolderChanged))
+	assert.Equal(t, 10, cap(w.Error))
+}
+
+func TestAddFolder(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, ExcludeSubdirs: true}, time.Millisecond)
+	require.NoError(t, err)
+
+	dir, _ := filepath.Abs("testdata/dir")
+	subdir, _ := filepath.Abs("testdata/dir/subdir")
+	assert.NoError(t, w.AddFolder("testdata/dir/subdir"))
+	assert.Equal(t, []string{dir, subdir}, w.WatchFolders())
+	assert.Equal(t, []string{"testdata/dir", "testdata/dir/subdir"}, w.options.RootFolders)
+
+	assert.Error(t, w.AddFolder("testdata/dir/subdir"))
+	assert.Error(t, w.AddFolder("testdata/bogus"))
+}
+
+func TestExcludeSubdirsNotifiesRoot(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "subdir"), 0755))
+	w, err := New(Options{RootFolders: []string{root}, ExcludeSubdirs: true, DebounceDuration: 10 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	go w.Start()
+	<-w.Ready
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "file"), nil, 0644))
+	select {
+	case folder := <-w.FolderChanged:
+		assert.Equal(t, root, folder)
+	case <-time.After(5 * time.Second):
+		t.Fatal("root folder wasn't notified")
+	}
+	assert.Equal(t, filepath.Join(root, "file"), <-w.FileChanged)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "file"), []byte("changed"), 0644))
+	select {
+	case folder := <-w.FolderChanged:
+		assert.Equal(t, root, folder)
+	case <-time.After(5 * time.Second):
+		t.Fatal("root folder wasn't notified")
+	}
+}
+
+func TestExcludedFilesDontNotifyFolder(t *testing.T) {
+	root := t.TempDir()
+	w, err := New(Options{RootFolders: []string{root}, ExcludePatterns: []string{"*.log"}, DebounceDuration: 10 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	go w.Start()
+	<-w.Ready
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "debug.log"), nil, 0644))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.Remove(filepath.Join(root, "debug.log")))
+	select {
+	case folder := <-w.FolderChanged:
+		t.Fatalf("folder %s was notified for an excluded file", folder)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, os.Mkdir(filepath.Join(root, "subdir"), 0755)) // subfolders still notify for their parent
+	folders := []string{}
+	for len(folders) < 2 {
+		select {
+		case folder := <-w.FolderChanged:
+			folders = append(folders, folder)
+		case <-time.After(5 * time.Second):
+			t.Fatal("folders weren't notified")
+		}
+	}
+	assert.ElementsMatch(t, []string{root, filepath.Join(root, "subdir")}, folders)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "file"), nil, 0644))
+	assert.Equal(t, filepath.Join(root, "file"), <-w.FileChanged)
+	select {
+	case folder := <-w.FolderChanged:
+		assert.Equal(t, root, folder)
+	case <-time.After(5 * time.Second):
+		t.Fatal("root folder wasn't notified")
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	options := Options{RootFolders: []string{"testdata/dir", "testdata/bogus"}, RootFiles: []string{"testdata/bogus.txt"}}
+	_, err := New(options, time.Millisecond)
+	assert.Error(t, err)
+
+	options.BestEffort = true
+	w, err := New(options, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	dir, _ := filepath.Abs("testdata/dir")
+	assert.Contains(t, w.WatchFolders(), dir)
+	go w.Start()
+
+	paths := []string{}
+	for i := 0; i < 2; i++ {
+		var watchErr *WatchError
+		require.ErrorAs(t, <-w.Error, &watchErr)
+		assert.Equal(t, "add", watchErr.Op)
+		assert.ErrorIs(t, watchErr, os.ErrNotExist)
+		paths = append(paths, watchErr.Path)
+	}
+	assert.Equal(t, []string{"testdata/bogus", "testdata/bogus.txt"}, paths)
+}
+
+func TestRootFor(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata", "testdata/dir/subdir"}, RootFiles: []string{"README.md"}, PublishEvents: true, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	root, _ := filepath.Abs("testdata")
+	subdir, _ := filepath.Abs("testdata/dir/subdir")
+	readme, _ := filepath.Abs("README.md")
+	assert.Equal(t, root, w.RootFor("testdata/dir/file"))
+	assert.Equal(t, subdir, w.RootFor("testdata/dir/subdir/file"))
+	assert.Equal(t, subdir, w.RootFor(subdir))
+	assert.Equal(t, readme, w.RootFor("README.md"))
+	assert.Equal(t, "", w.RootFor("watcher.go"))
+
+	path, _ := filepath.Abs("testdata/test")
+	w.fire(Event{Path: path, Op: Write})
+	assert.Equal(t, root, (<-w.Events).Root)
+}
+
+func TestWalkTimeout(t *testing.T) {
+	fast, slow := t.TempDir(), t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(slow, "mount"), 0755))
+	release := make(chan struct{})
+	defer close(release)
+	filter := func(path string, info os.FileInfo) bool {
+		if path == filepath.Join(slow, "mount") {
+			<-release // an unresponsive network mount
+		}
+		return true
+	}
+	options := Options{RootFolders: []string{fast, slow}, Filter: filter, WalkTimeout: 50 * time.Millisecond}
+	_, err := New(options, time.Millisecond)
+	assert.ErrorIs(t, err, ErrWalkTimeout)
+
+	options.BestEffort = true
+	w, err := New(options, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.mutex.Lock()
+	assert.Equal(t, map[string]bool{fast: true}, w.folders)
+	w.mutex.Unlock()
+	go w.Start()
+	var watchErr *WatchError
+	require.ErrorAs(t, <-w.Error, &watchErr)
+	assert.Equal(t, slow, watchErr.Path)
+	assert.ErrorIs(t, watchErr, ErrWalkTimeout)
+}
+
+func TestExpandChildrenAsRoots(t *testing.T) {
+	projects := t.TempDir()
+	repo1, repo2 := filepath.Join(projects, "repo1"), filepath.Join(projects, "repo2")
+	for _, dir := range []string{filepath.Join(repo1, "build"), filepath.Join(repo2, "build")} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(repo1, ".watchignore"), []byte("build\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(projects, "notes.txt"), nil, 0644))
+
+	w, err := New(Options{RootFolders: []string{projects}, ExpandChildrenAsRoots: true, Watchignore: true, FollowNewFolders: true}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.mutex.Lock()
+	assert.Equal(t, map[string]bool{repo1: true, repo2: true, filepath.Join(repo2, "build"): true}, w.folders)
+	w.mutex.Unlock()
+	assert.Equal(t, repo1, w.RootFor(filepath.Join(repo1, "main.go")))
+	assert.Equal(t, "", w.RootFor(filepath.Join(projects, "notes.txt")))
+
+	go w.Start()
+	<-w.Ready
+	repo3 := filepath.Join(projects, "repo3")
+	require.NoError(t, os.Mkdir(repo3, 0755))
+	require.Eventually(t, func() bool { return w.RootFor(repo3) == repo3 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, os.WriteFile(filepath.Join(projects, "notes.txt"), []byte("changed"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(repo3, "file"), nil, 0644))
+	assert.Equal(t, filepath.Join(repo3, "file"), <-w.FileChanged)
+}
+
+func TestRemoveFolder(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}}, time.Minute)
+	require.NoError(t, err)
+
+	dir, _ := filepath.Abs("testdata/dir")
+	subdir, _ := filepath.Abs("testdata/dir/subdir")
+	exclude, _ := filepath.Abs("testdata/dir/exclude")
+	w.debounceItem(w.fileDebounce, Event{Path: filepath.Join(exclude, "file")})
+	w.debounceItem(w.folderDebounce, Event{Path: exclude, IsDir: true})
+	w.debounceItem(w.folderDebounce, Event{Path: subdir, IsDir: true})
+
+	assert.NoError(t, w.RemoveFolder("testdata/dir/exclude"))
+	assert.Equal(t, []string{dir, subdir}, w.WatchFolders())
+	assert.Empty(t, w.fileDebounce)
+	assert.Len(t, w.folderDebounce, 1)
+	assert.Error(t, w.RemoveFolder("testdata/dir/exclude"))
+
+	assert.NoError(t, w.RemoveFolder("testdata/dir"))
+	assert.Empty(t, w.WatchFolders())
+	assert.Empty(t, w.folderDebounce)
+	assert.Empty(t, w.options.RootFolders)
+}
+
+func TestEmptyFolderCreated(t *testing.T) {
+	root := t.TempDir()
+	w, err := New(Options{RootFolders: []string{root}, FollowNewFolders: true, PublishEvents: true}, 10*time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+
+	sub := filepath.Join(root, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+	events := []Event{}
+	for len(events) < 2 { // the new folder along with its parent, whose modification time changed
+		select {
+		case event := <-w.Events:
+			events = append(events, withoutStat(event)...)
+		case <-w.FolderChanged:
+		case <-time.After(time.Second):
+			t.Fatal("expected notifications for the new folder")
+		}
+	}
+	assert.Contains(t, events, Event{Path: sub, Op: Create, IsDir: true})
+}
+
+func TestRestart(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "old"), 0755))
+	w, err := New(Options{RootFolders: []string{root}, DebounceDuration: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: filepath.Join(root, "file")})
+	w.mutex.Unlock()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "new"), 0755)) // missed since FollowNewFolders isn't set
+	require.NoError(t, os.Mkdir(filepath.Join(root, "old", ".hidden"), 0755))
+	w.mutex.Lock()
+	w.folders[filepath.Join(root, "old", ".hidden")] = true // drifted into the watch set
+	w.mutex.Unlock()
+
+	require.NoError(t, w.Restart())
+	w.mutex.Lock()
+	assert.Equal(t, map[string]bool{root: true, filepath.Join(root, "new"): true, filepath.Join(root, "old"): true}, w.folders)
+	assert.Empty(t, w.fileDebounce)
+	w.mutex.Unlock()
+}
+
+func TestNewMulti(t *testing.T) {
+	_, err := NewMulti(nil, time.Millisecond)
+	assert.Error(t, err)
+	_, err = NewMulti([]RootConfig{{Path: "testdata"}, {Path: "testdata/."}}, time.Millisecond)
+	assert.Error(t, err)
+
+	data := t.TempDir()
+	config := t.TempDir()
+	w, err := NewMulti([]RootConfig{
+		{Path: data, Options: Options{FollowNewFolders: true, ExcludePatterns: []string{"*.log"}}},
+		{Path: config},
+		{Path: "testdata/dir", Options: Options{FolderExclusions: []string{"exclude"}}},
+	}, time.Millisecond)
+	require.NoError(t, err)
+	dir, _ := filepath.Abs("testdata/dir")
+	w.mutex.Lock()
+	assert.Equal(t, map[string]bool{data: true, config: true, dir: true, filepath.Join(dir, "subdir"): true}, w.folders)
+	w.mutex.Unlock()
+
+	assert.True(t, w.shouldFollow(filepath.Join(data, "new")))
+	assert.False(t, w.shouldFollow(filepath.Join(config, "new")))
+	assert.False(t, w.isIncludedFile(filepath.Join(data, "app.log")))
+	assert.True(t, w.isIncludedFile(filepath.Join(config, "app.log")))
+	assert.False(t, w.IsExcluded(filepath.Join(config, "exclude")))
+	assert.True(t, w.IsExcluded(filepath.Join(dir, "exclude")))
+}
+
+func TestIsSubpath(t *testing.T) {
+	assert.True(t, isSubpath("/a/b", "/a/b"))
+	assert.True(t, isSubpath("/a/b/c", "/a/b"))
+	assert.True(t, isSubpath("/a/b/c", "/"))
+	assert.False(t, isSubpath("/a/bc", "/a/b"))
+}
+
+func TestShouldFollow(t *testing.T) {
+	w := &Filewatcher{options: Options{RootFolders: []string{"testdata"}, FollowNewFolders: true, MaxDepth: 2}}
+	root, _ := filepath.Abs("testdata")
+	assert.True(t, w.shouldFollow(filepath.Join(root, "new")))
+	assert.True(t, w.shouldFollow(filepath.Join(root, "dir", "new")))
+	assert.False(t, w.shouldFollow(filepath.Join(root, "dir", "subdir", "new")))
+	assert.False(t, w.shouldFollow(filepath.Join(root, ".new")))
+
+	w.options.MaxDepth = 0
+	assert.True(t, w.shouldFollow(filepath.Join(root, "dir", "subdir", "new")))
+
+	w.options.FollowNewFoldersPattern = "session[0-9]*"
+	assert.True(t, w.shouldFollow(filepath.Join(root, "session001")))
+	assert.False(t, w.shouldFollow(filepath.Join(root, "new")))
+	assert.False(t, w.shouldFollow(filepath.Join(root, "Session001")))
+	w.options.FollowNewFoldersPattern = ""
+
+	w.options.FollowNewFolders = false
+	assert.False(t, w.shouldFollow(filepath.Join(root, "new")))
+
+	_, err := New(Options{RootFolders: []string{"testdata"}, FollowNewFolders: true, FollowNewFoldersPattern: "["}, time.Millisecond)
+	assert.ErrorIs(t, err, filepath.ErrBadPattern)
+}
+
+func TestShouldFollowSymlinks(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	require.NoError(t, os.Symlink(root, filepath.Join(root, "loop")))
+	require.NoError(t, os.Symlink(other, filepath.Join(root, "link")))
+
+	w := &Filewatcher{options: Options{RootFolders: []string{root}, FollowNewFolders: true, FollowSymlinks: true}}
+	assert.False(t, w.shouldFollow(filepath.Join(root, "loop")))
+	assert.True(t, w.shouldFollow(filepath.Join(root, "link")))
+}
+
+func TestRootDepth(t *testing.T) {
+	w := &Filewatcher{options: Options{RootFolders: []string{"testdata", "testdata/dir"}}}
+	root, _ := filepath.Abs("testdata")
+	assert.Equal(t, 0, w.rootDepth(root))
+	assert.Equal(t, 1, w.rootDepth(filepath.Join(root, "test")))
+	assert.Equal(t, 1, w.rootDepth(filepath.Join(root, "dir", "subdir")))
+	assert.Equal(t, -1, w.rootDepth("/elsewhere"))
 }
 
 func TestWatch(t *testing.T) {
@@ -50,7 +447,7 @@ func TestWatch(t *testing.T) {
 				called++
 				mutex.Unlock()
 			case <-w.FolderChanged:
-			case <-w.watcher.Closed:
+			case <-w.Closed:
 				return
 			}
 		}
@@ -65,11 +462,363 @@ func TestWatch(t *testing.T) {
 
 	w.Close()
 
+	mutex.Lock()
 	assert.Equal(t, 2, called)
+	mutex.Unlock()
+}
+
+func TestStartContext(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- w.StartContext(ctx)
+	}()
+	cancel()
+
+	assert.Equal(t, context.Canceled, <-errc)
+	_, ok := <-w.FileChanged
+	assert.False(t, ok)
+}
+
+func TestStartContextError(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	w.pollDuration = 0 // rejected by the underlying watcher
+
+	assert.Equal(t, watcher.ErrDurationTooShort, w.StartContext(context.Background()))
+	_, ok := <-w.FileChanged
+	assert.False(t, ok)
+	w.Wait()
+}
+
+func TestIsRunning(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, w.IsRunning())
+	go w.Start()
+	w.underlying().Wait()
+
+	require.Eventually(t, w.IsRunning, time.Second, time.Millisecond)
+	polled := w.LastPollTime()
+	require.Eventually(t, func() bool { return w.LastPollTime().After(polled) }, time.Second, time.Millisecond)
+	w.Close()
+	assert.False(t, w.IsRunning())
+}
+
+func TestReady(t *testing.T) {
+	root := t.TempDir()
+	w, err := New(Options{RootFolders: []string{root}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	select {
+	case <-w.Ready:
+		t.Fatal("expected Ready to stay open until Start is called")
+	default:
+	}
+
+	go w.Start()
+	<-w.Ready
+	path := filepath.Join(root, "file")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	assert.Equal(t, path, <-w.FileChanged)
+}
+
+func TestStartPaused(t *testing.T) {
+	root := t.TempDir()
+	w, err := New(Options{RootFolders: []string{root}, StartPaused: true}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	go w.Start()
+	path := filepath.Join(root, "file")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	select {
+	case <-w.Ready:
+		t.Fatal("expected the watcher to wait for Arm")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.False(t, w.IsRunning())
+
+	w.Arm()
+	<-w.Ready
+	assert.Equal(t, path, <-w.FileChanged) // changed before Arm
+
+	w, err = New(Options{RootFolders: []string{root}, StartPaused: true}, time.Millisecond)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, w.StartContext(ctx), context.Canceled)
+	<-w.Closed
+}
+
+func TestSetPollDuration(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: 50 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Error(t, w.SetPollDuration(100*time.Millisecond))
+	assert.NoError(t, w.SetPollDuration(10*time.Millisecond))
+	assert.Equal(t, 50*time.Millisecond, w.DebounceDuration())
+	assert.Equal(t, 10*time.Millisecond, w.PollDuration())
+
+	root := t.TempDir()
+	w, err = New(Options{RootFolders: []string{root}}, 50*time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+	require.Eventually(t, w.IsRunning, time.Second, time.Millisecond)
+
+	original := w.underlying()
+	require.NoError(t, w.SetPollDuration(5*time.Millisecond))
+	assert.NotEqual(t, original, w.underlying())
+	assert.Equal(t, 10*time.Millisecond, w.DebounceDuration())
+	assert.Equal(t, 5*time.Millisecond, w.PollDuration())
+
+	// the replacement carries on watching the same folders without closing the watcher
+	path := filepath.Join(root, "file")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.True(t, w.IsRunning())
+	select {
+	case <-w.Closed:
+		t.Fatal("expected the watcher to stay open")
+	default:
+	}
+}
+
+func TestSetIncludeHidden(t *testing.T) {
+	root := t.TempDir()
+	hidden := filepath.Join(root, ".hidden")
+	require.NoError(t, os.Mkdir(hidden, 0755))
+	env := filepath.Join(root, ".env")
+	require.NoError(t, os.WriteFile(env, nil, 0644))
+	w, err := New(Options{RootFolders: []string{root}}, 5*time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+	require.Eventually(t, w.IsRunning, time.Second, time.Millisecond)
+	assert.False(t, w.IsWatching(hidden))
+
+	require.NoError(t, w.SetIncludeHidden(true))
+	assert.True(t, w.IsWatching(hidden))
+	assert.True(t, w.GetOptions().IncludeHidden)
+	assert.Contains(t, w.underlying().WatchedFiles(), env)
+	path := filepath.Join(hidden, "file")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	assert.Equal(t, path, <-w.FileChanged)
+
+	require.NoError(t, w.SetIncludeHidden(false))
+	assert.False(t, w.IsWatching(hidden))
+	assert.NotContains(t, w.underlying().WatchedFiles(), env)
+	assert.True(t, w.IsRunning())
+
+	w.Close()
+	assert.ErrorIs(t, w.SetIncludeHidden(true), os.ErrClosed)
+}
+
+func TestWait(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	w.underlying().Wait()
+
+	path, _ := filepath.Abs("testdata/test")
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: path})
+	w.mutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		w.Wait()
+		close(finished)
+	}()
+	w.Close()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after Close")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	w.underlying().Wait()
+
+	assert.NotPanics(t, func() {
+		w.Close()
+		w.Close()
+	})
+}
+
+func TestFlushAndClose(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Minute, BatchWindow: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	w.underlying().Wait()
+
+	path, _ := filepath.Abs("testdata/test")
+	folder, _ := filepath.Abs("testdata")
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+	w.debounceItem(w.folderDebounce, Event{Path: folder, Op: Write, IsDir: true})
+	w.mutex.Unlock()
+
+	errc := make(chan error)
+	go func() { errc <- w.FlushAndClose() }()
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, folder, <-w.FolderChanged)
+	assert.Equal(t, []string{path}, <-w.BatchChanged)
+	assert.NoError(t, <-errc)
+	_, ok := <-w.FileChanged
+	assert.False(t, ok)
+}
+
+func TestFlushAndCloseWhilePaused(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Minute, BufferWhilePaused: true}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	w.underlying().Wait()
+
+	path, _ := filepath.Abs("testdata/test")
+	folder, _ := filepath.Abs("testdata")
+	w.Pause()
+	w.fire(Event{Path: path, Op: Write}) // a timer which fired while paused
+	info, err := os.Stat(folder)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: folder, FileInfo: info}) // buffered while paused
+
+	errc := make(chan error)
+	go func() { errc <- w.FlushAndClose() }()
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, folder, <-w.FolderChanged)
+	assert.NoError(t, <-errc)
+}
+
+func TestCloseErr(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	w.underlying().Wait()
+
+	assert.NoError(t, w.CloseErr())
+	assert.NoError(t, w.CloseErr())
+	w.Wait()
+
+	fake := newFakeWatcher()
+	fake.closeErr = errors.New("close failed")
+	w, err = New(Options{RootFolders: []string{"testdata"}, NewWatcher: func() (Watcher, error) { return fake, nil }}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, fake.closeErr, w.CloseErr())
+	assert.Equal(t, fake.closeErr, w.CloseErr())
+}
+
+type testLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.mutex.Lock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+	l.mutex.Unlock()
+}
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	_, err := New(Options{RootFolders: []string{"testdata/dir"}, FolderExclusions: []string{"exclude"}, Logger: logger}, time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"adding folder testdata/dir",
+		"skipping folder testdata/dir/.hidden: hidden folder",
+		"skipping folder testdata/dir/exclude: excluded folder",
+		"adding folder testdata/dir/subdir",
+	}, logger.messages)
+}
+
+func TestNotifyExisting(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, FolderExclusions: []string{"exclude"}, NotifyExisting: true}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+
+	file, _ := filepath.Abs("testdata/dir/file")
+	subdirFile, _ := filepath.Abs("testdata/dir/subdir/file")
+	assert.Equal(t, file, <-w.FileChanged)
+	assert.Equal(t, subdirFile, <-w.FileChanged)
+	w.Close()
+
+	// polling doesn't start until the consumer has received the existing files
+	w, err = New(Options{RootFolders: []string{"testdata/dir"}, FolderExclusions: []string{"exclude"}, NotifyExisting: true, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+	listening := make(chan bool, 1)
+	go func() { listening <- w.startListening() }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, listening)
+	assert.Equal(t, file, <-w.FileChanged)
+	assert.Equal(t, subdirFile, <-w.FileChanged)
+	assert.True(t, <-listening)
+	w.Close()
+}
+
+func TestNotifyExistingFilters(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"file.txt", "file.txt~", ".env", "muted", "filtered"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), nil, 0644))
+	}
+	filter := func(path string, info os.FileInfo) bool { return filepath.Base(path) != "filtered" }
+	w, err := New(Options{RootFolders: []string{root}, NotifyExisting: true, IgnoreEditorTemp: true, IncludeHiddenFolders: true, Filter: filter}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.Mute(filepath.Join(root, "muted"))
+	assert.Equal(t, []string{filepath.Join(root, "file.txt")}, w.existingFiles())
+}
+
+func TestNotifyExistingFolders(t *testing.T) {
+	dir, _ := filepath.Abs("testdata/dir")
+	subdir, _ := filepath.Abs("testdata/dir/subdir")
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, FolderExclusions: []string{"exclude"}, NotifyExisting: true, FolderEventsOnly: true, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	assert.Equal(t, dir, <-w.FolderChanged)
+	assert.Equal(t, subdir, <-w.FolderChanged)
+	<-w.Ready // without FileChanged being drained
+	assert.Empty(t, w.FileChanged)
+	w.Close()
+
+	w, err = New(Options{RootFolders: []string{"testdata/dir"}, FolderExclusions: []string{"exclude"}, NotifyExisting: true, CollapseToRoot: true, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	assert.Equal(t, dir, <-w.FolderChanged)
+	<-w.Ready
+	assert.Empty(t, w.FileChanged)
+	assert.Empty(t, w.FolderChanged)
+	w.Close()
 }
 
 func TestGetWatcherPath(t *testing.T) {
-	assert.Equal(t, "myNewFile", getWatcherPath("myFile -> myNewFile")) // simulate move or rename event
+	path, oldPath := getWatcherPaths(watcher.Event{Op: watcher.Rename, Path: "myFile -> myNewFile"}) // simulate older rename event
+	assert.Equal(t, "myNewFile", path)
+	assert.Equal(t, "myFile", oldPath)
+
+	path, oldPath = getWatcherPaths(watcher.Event{Op: watcher.Move, Path: "new -> file", OldPath: "old"})
+	assert.Equal(t, "new -> file", path)
+	assert.Equal(t, "old", oldPath)
+
+	path, oldPath = getWatcherPaths(watcher.Event{Op: watcher.Write, Path: "my -> file", OldPath: "my -> file"})
+	assert.Equal(t, "my -> file", path)
+	assert.Equal(t, "", oldPath)
+
+	// the destination which exists is preferred when the paths themselves contain the separator
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "b -> c"), nil, 0644))
+	path, oldPath = splitRenamePath(filepath.Join(root, "a") + " -> " + filepath.Join(root, "b -> c"))
+	assert.Equal(t, filepath.Join(root, "b -> c"), path)
+	assert.Equal(t, filepath.Join(root, "a"), oldPath)
 }
 
 func TestWatchFolders(t *testing.T) {
@@ -96,6 +845,18 @@ func TestWatchFolders(t *testing.T) {
 				IncludeHidden: true,
 			},
 			[]string{dir, hidden, exclude, excludeSubdir, subdir}},
+		{"hidden folders only",
+			Options{
+				RootFolders:          []string{"testdata/dir"},
+				IncludeHiddenFolders: true,
+			},
+			[]string{dir, hidden, exclude, excludeSubdir, subdir}},
+		{"hidden files only",
+			Options{
+				RootFolders:        []string{"testdata/dir"},
+				IncludeHiddenFiles: true,
+			},
+			[]string{dir, exclude, excludeSubdir, subdir}},
 		{"no hidden",
 			Options{
 				RootFolders: []string{"testdata/dir"},
@@ -112,6 +873,30 @@ func TestWatchFolders(t *testing.T) {
 				RootFolders: []string{"testdata/dir/."},
 			},
 			[]string{dir, exclude, excludeSubdir, subdir}},
+		{"max depth",
+			Options{
+				RootFolders: []string{"testdata/dir"},
+				MaxDepth:    1,
+			},
+			[]string{dir, exclude, subdir}},
+		{"exclusion patterns",
+			Options{
+				RootFolders:             []string{"testdata/dir"},
+				FolderExclusionPatterns: []string{`exclude$`},
+			},
+			[]string{dir, subdir}},
+		{"exclude prefixes",
+			Options{
+				RootFolders:     []string{"testdata/dir"},
+				ExcludePrefixes: []string{"testdata/dir/exclude/othersubdir", "testdata/dir/sub"},
+			},
+			[]string{dir, exclude, subdir}},
+		{"exclusion patterns only match full path",
+			Options{
+				RootFolders:             []string{"testdata/dir"},
+				FolderExclusionPatterns: []string{`dir$`},
+			},
+			[]string{}},
 		{"without exclude",
 			Options{
 				RootFolders:      []string{"testdata/dir"},
@@ -129,3 +914,1671 @@ func TestWatchFolders(t *testing.T) {
 		})
 	}
 }
+
+func TestWatchCounts(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, IncludeHidden: true}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, len(w.WatchFolders()), w.WatchFolderCount())
+	assert.Equal(t, 5, w.WatchFolderCount())
+	assert.Equal(t, 5, w.WatchFileCount())
+}
+
+func TestIsWatching(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, RootFiles: []string{"testdata/test"}, FolderExclusions: []string{"exclude"}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	subdir, _ := filepath.Abs("testdata/dir/subdir")
+	assert.True(t, w.IsWatching("testdata/dir"))
+	assert.True(t, w.IsWatching(subdir))
+	assert.True(t, w.IsWatching("testdata/test"))
+	assert.False(t, w.IsWatching("testdata/dir/exclude"))
+	assert.False(t, w.IsWatching("testdata/dir/file"))
+	require.NoError(t, w.RemoveFolder("testdata/dir/subdir"))
+	assert.False(t, w.IsWatching(subdir))
+}
+
+func TestInitialFolders(t *testing.T) {
+	root := t.TempDir()
+	empty := filepath.Join(root, "empty")
+	require.NoError(t, os.Mkdir(empty, 0755))
+	other := t.TempDir()
+	w, err := New(Options{RootFolders: []string{root}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, []string{root, empty}, w.InitialFolders())
+	assert.NotContains(t, w.WatchFolders(), empty) // derived from the watched files, so empty folders are missing
+
+	require.NoError(t, w.AddFolder(other))
+	require.NoError(t, w.RemoveFolder(empty))
+	assert.Equal(t, []string{root, empty}, w.InitialFolders())
+}
+
+func TestExactFolders(t *testing.T) {
+	root := t.TempDir()
+	a, b, c := filepath.Join(root, "a"), filepath.Join(root, "a", "b"), filepath.Join(root, "a", "b", "c")
+	require.NoError(t, os.MkdirAll(c, 0755))
+	walked := []string{}
+	w, err := New(Options{ExactFolders: []string{a, c}, Filter: func(path string, info os.FileInfo) bool {
+		if info.IsDir() {
+			walked = append(walked, path)
+		}
+		return true
+	}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Empty(t, walked) // added straight away rather than listed
+	assert.Equal(t, []string{a, c}, w.InitialFolders())
+	assert.False(t, w.IsWatching(b))
+	assert.Equal(t, c, w.RootFor(filepath.Join(c, "file")))
+
+	require.NoError(t, w.RemoveFolder(c))
+	assert.Equal(t, []string{a}, w.GetOptions().ExactFolders)
+}
+
+func TestWatchedFiles(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, ExcludeSubdirs: true}, time.Millisecond)
+	require.NoError(t, err)
+
+	files := w.WatchedFiles()
+	dir, _ := filepath.Abs("testdata/dir")
+	subdir, _ := filepath.Abs("testdata/dir/subdir")
+	assert.Contains(t, files, dir)
+	assert.Contains(t, files, subdir)
+	assert.True(t, sort.StringsAreSorted(files))
+}
+
+func TestWatchFoldersWhileWatching(t *testing.T) {
+	root := t.TempDir()
+	w, err := New(Options{RootFolders: []string{root}, FollowNewFolders: true}, 5*time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+	go func() {
+		for range w.FileChanged {
+		}
+	}()
+	go func() {
+		for range w.FolderChanged {
+		}
+	}()
+	go func() { // deleted folders are reported until they're removed
+		for {
+			select {
+			case <-w.Error:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	last := filepath.Join(root, "folder19")
+	go func() { // folders are added and removed by the listen goroutine as they're created and deleted
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			folder := filepath.Join(root, fmt.Sprintf("folder%d", i))
+			_ = os.Mkdir(folder, 0755)
+			_ = os.WriteFile(filepath.Join(folder, "file"), nil, 0644)
+			if i%2 == 1 {
+				_ = os.RemoveAll(filepath.Join(root, fmt.Sprintf("folder%d", i-1)))
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		w.WatchFolders()
+		w.WatchedFiles()
+		w.WatchFileCount()
+		w.IsWatching(last)
+	}
+	assert.Eventually(t, func() bool {
+		for _, folder := range w.WatchFolders() {
+			if folder == last {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+}
+
+func TestIsExcluded(t *testing.T) {
+	w, err := New(Options{
+		RootFolders:      []string{"testdata/dir"},
+		FolderExclusions: []string{"exclude"},
+		ExcludePatterns:  []string{"*.tmp"},
+		MaxDepth:         1,
+	}, time.Millisecond)
+	require.NoError(t, err)
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"testdata/dir", false},
+		{"testdata/dir/file", false},
+		{"testdata/dir/subdir/file", false},
+		{"testdata/dir/new.txt", false},
+		{"testdata/dir/new.tmp", true},
+		{"testdata/dir/.file", true},
+		{"testdata/dir/.hidden", true},
+		{"testdata/dir/.hidden/file", true},
+		{"testdata/dir/exclude", true},
+		{"testdata/dir/exclude/othersubdir/file", true},
+		{"testdata/dir/subdir/a/b", true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, w.IsExcluded(tt.path), tt.path)
+	}
+}
+
+func TestDeletedFolder(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	require.NoError(t, os.MkdirAll(filepath.Join(sub, "nested"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "file"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(sub, "nested", "file"), nil, 0644))
+
+	w, err := New(Options{RootFolders: []string{root}}, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, []string{root, filepath.Join(sub, "nested")}, w.WatchFolders())
+	assert.Equal(t, 3, w.Stats().WatchedFolders)
+	go func() { // the underlying watcher reports each deleted folder as an error
+		for {
+			select {
+			case <-w.Error:
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+
+	require.NoError(t, os.RemoveAll(sub))
+	require.Eventually(t, func() bool {
+		return w.Stats().WatchedFolders == 1 && len(w.WatchFolders()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{root}, w.WatchFolders())
+	assert.Equal(t, root, <-w.FolderChanged)
+}
+
+func TestDeletedRoot(t *testing.T) {
+	deleted := t.TempDir()
+	kept := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(deleted, "sub", "nested"), 0755))
+	file := filepath.Join(kept, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+
+	w, err := New(Options{RootFolders: []string{deleted, kept}, NotifyRemoved: true}, 10*time.Millisecond)
+	require.NoError(t, err)
+	go w.Start()
+	defer w.Close()
+	w.underlying().Wait()
+
+	require.NoError(t, os.RemoveAll(deleted))
+	err = <-w.Error
+	assert.Equal(t, &WatchError{Op: "watch", Path: deleted, Err: ErrRootFolderDeleted}, err)
+	assert.Equal(t, deleted, <-w.FolderRemoved)
+	assert.Equal(t, []string{kept}, w.GetOptions().RootFolders)
+
+	require.NoError(t, os.WriteFile(file, []byte("changed"), 0644)) // the other root keeps working
+	assert.Equal(t, file, <-w.FileChanged)
+	select {
+	case err := <-w.Error:
+		t.Fatalf("expected a single error, got %v", err)
+	default:
+	}
+}
+
+func TestUpdateOptions(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}}, time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, w.isExcludedFolder("/a/build"))
+
+	options := w.GetOptions()
+	options.FolderExclusions = []string{"build"}
+	options.ExcludePatterns = []string{"*.tmp"}
+	options.RootFolders = []string{"elsewhere"}
+	require.NoError(t, w.UpdateOptions(options))
+	assert.True(t, w.isExcludedFolder("/a/build"))
+	assert.False(t, w.isIncludedFile("/a/file.tmp"))
+	assert.Equal(t, []string{"testdata/dir"}, w.GetOptions().RootFolders)
+	assert.Equal(t, []string{string(filepath.Separator) + "build" + string(filepath.Separator)}, w.GetOptions().FolderExclusions)
+
+	// the returned options can't be used to modify the watcher
+	w.GetOptions().FolderExclusions[0] = "other"
+	assert.True(t, w.isExcludedFolder("/a/build"))
+
+	options.FolderExclusionPatterns = []string{"["}
+	assert.Error(t, w.UpdateOptions(options))
+	assert.True(t, w.isExcludedFolder("/a/build"))
+}
+
+func TestUpdateOptionsWhileLogging(t *testing.T) {
+	logger := &testLogger{}
+	w, err := New(Options{RootFolders: []string{"testdata"}, Logger: logger}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	done := make(chan struct{})
+	go func() { // logged without the mutex, like the debounce goroutines do
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w.debugf("message %d", i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, w.UpdateOptions(w.GetOptions()))
+	}
+	<-done
+	logger.mutex.Lock()
+	assert.Contains(t, logger.messages, "message 99")
+	logger.mutex.Unlock()
+}
+
+func TestWatchError(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+	w, err := New(Options{RootFolders: []string{root}}, time.Millisecond)
+	require.NoError(t, err)
+
+	err = w.watchError(&os.PathError{Op: "open", Path: "/a", Err: fs.ErrPermission})
+	assert.Equal(t, "open /a: permission denied", err.Error())
+	assert.ErrorIs(t, err, fs.ErrPermission)
+
+	require.NoError(t, os.Remove(sub))
+	errs := w.deletedErrors()
+	assert.Equal(t, []error{&WatchError{Op: "watch", Path: sub, Err: watcher.ErrWatchedFileDeleted}}, errs)
+	assert.ErrorIs(t, errs[0], watcher.ErrWatchedFileDeleted)
+	assert.Empty(t, w.deletedErrors()) // already forgotten
+
+	assert.Equal(t, fs.ErrClosed, w.watchError(fs.ErrClosed))
+	w.Close()
+}
+
+func TestPlanWatch(t *testing.T) {
+	logger := &testLogger{}
+	folders, err := PlanWatch(Options{RootFolders: []string{"testdata/dir"}, FolderExclusions: []string{"exclude"}, Logger: logger})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"testdata/dir", filepath.Join("testdata/dir", "subdir")}, folders)
+	assert.Contains(t, logger.messages, "skipping folder testdata/dir/exclude: excluded folder")
+
+	_, err = PlanWatch(Options{RootFolders: []string{"testdata/dir"}, FolderExclusionPatterns: []string{"["}})
+	assert.Error(t, err)
+	_, err = PlanWatch(Options{RootFolders: []string{"testdata/test"}})
+	assert.Error(t, err)
+}
+
+func TestPlanWatchMatchesNew(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"a/node_modules", "a/src", "b/dist", "b/lib"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a", ".watchignore"), []byte("node_modules\n"), 0644))
+	options := Options{RootFolders: []string{root}, ExpandChildrenAsRoots: true, Watchignore: true, FolderExclusions: []string{"dist"}}
+
+	planned, err := PlanWatch(options)
+	require.NoError(t, err)
+	w, err := New(options, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, []string{filepath.Join(root, "a"), filepath.Join(root, "a", "src"), filepath.Join(root, "b"), filepath.Join(root, "b", "lib")}, w.InitialFolders())
+	assert.Equal(t, w.InitialFolders(), planned)
+}
+
+func TestSkippedFolders(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{".git", "node_modules", filepath.Join("src", "pkg", "deep")} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	w, err := New(Options{RootFolders: []string{root}, FolderExclusions: []string{"node_modules"}, MaxDepth: 1}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, []SkipInfo{
+		{Path: filepath.Join(root, ".git"), Reason: "hidden folder"},
+		{Path: filepath.Join(root, "node_modules"), Reason: "excluded folder"},
+		{Path: filepath.Join(root, "src", "pkg"), Reason: "deeper than max depth"},
+	}, w.SkippedFolders())
+
+	require.NoError(t, os.RemoveAll(filepath.Join(root, ".git")))
+	require.NoError(t, w.Restart())
+	assert.Len(t, w.SkippedFolders(), 2)
+	require.NoError(t, w.RemoveFolder(root))
+	assert.Empty(t, w.SkippedFolders())
+}
+
+func TestOverlappingRoots(t *testing.T) {
+	logger := &testLogger{}
+	folders, err := PlanWatch(Options{RootFolders: []string{"testdata/dir/subdir", "testdata/dir", "./testdata/dir"}, FolderExclusions: []string{"exclude"}, Logger: logger})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"testdata/dir/subdir", "testdata/dir"}, folders)
+	assert.Contains(t, logger.messages, "root folder ./testdata/dir overlaps another root folder, so 2 of its folders are only watched once")
+
+	fake := &countingWatcher{fakeWatcher: newFakeWatcher(), adds: make(map[string]int)}
+	w, err := New(Options{RootFolders: []string{"testdata/dir", "testdata/dir/subdir"}, NewWatcher: func() (Watcher, error) { return fake, nil }}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, map[string]int{"testdata/dir": 1, "testdata/dir/exclude": 1, "testdata/dir/exclude/othersubdir": 1, "testdata/dir/subdir": 1}, fake.adds)
+}
+
+// flakyWatcher fails to add each path the given number of times before succeeding
+type flakyWatcher struct {
+	*fakeWatcher
+	failures int
+	attempts map[string]int
+}
+
+func (f *flakyWatcher) Add(name string) error {
+	f.mutex.Lock()
+	f.attempts[name]++
+	failed := f.attempts[name] <= f.failures
+	f.mutex.Unlock()
+	if failed {
+		return &os.PathError{Op: "add", Path: name, Err: errors.New("locked")}
+	}
+	return f.fakeWatcher.Add(name)
+}
+
+func TestBeforeAddFolder(t *testing.T) {
+	root := t.TempDir()
+	keep, skip := filepath.Join(root, "keep"), filepath.Join(root, "skip")
+	var mutex sync.Mutex
+	asked := []string{}
+	w, err := New(Options{RootFolders: []string{root}, FollowNewFolders: true, DebounceDuration: time.Minute, BeforeAddFolder: func(path string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		asked = append(asked, path)
+		return path == keep
+	}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for _, folder := range []string{keep, skip} {
+		require.NoError(t, os.Mkdir(folder, 0755))
+		info, err := os.Stat(folder)
+		require.NoError(t, err)
+		w.debounce(watcher.Event{Op: watcher.Create, Path: folder, FileInfo: info})
+	}
+	mutex.Lock()
+	assert.Equal(t, []string{keep, skip}, asked)
+	mutex.Unlock()
+	require.Eventually(t, func() bool { return w.IsWatching(keep) }, time.Second, time.Millisecond)
+	assert.False(t, w.IsWatching(skip))
+	assert.ElementsMatch(t, []string{keep, skip}, w.PendingFolders()) // still notified, just not watched
+}
+
+func TestAddRetries(t *testing.T) {
+	root := t.TempDir()
+	fake := &flakyWatcher{fakeWatcher: newFakeWatcher(), failures: 2, attempts: make(map[string]int)}
+	options := Options{RootFolders: []string{root}, FollowNewFolders: true, AddRetries: 2, AddRetryDelay: time.Millisecond, NewWatcher: func() (Watcher, error) { return fake, nil }}
+	w, err := New(options, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, map[string]int{root: 3}, fake.attempts)
+
+	followed := filepath.Join(root, "new")
+	require.NoError(t, os.Mkdir(followed, 0755))
+	info, err := os.Stat(followed)
+	require.NoError(t, err)
+	fake.mutex.Lock()
+	fake.failures = 5
+	fake.mutex.Unlock()
+	w.debounce(watcher.Event{Op: watcher.Create, Path: followed, FileInfo: info})
+	var watchErr *WatchError
+	require.ErrorAs(t, <-w.Error, &watchErr)
+	assert.Equal(t, followed, watchErr.Path)
+	fake.mutex.Lock()
+	assert.Equal(t, 3, fake.attempts[followed])
+	fake.mutex.Unlock()
+
+	fake = &flakyWatcher{fakeWatcher: newFakeWatcher(), failures: 3, attempts: make(map[string]int)}
+	_, err = New(options, time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, map[string]int{root: 3}, fake.attempts)
+}
+
+// countingWatcher counts how often each path is added
+type countingWatcher struct {
+	*fakeWatcher
+	adds map[string]int
+}
+
+func (c *countingWatcher) Add(name string) error {
+	c.mutex.Lock()
+	c.adds[name]++
+	c.mutex.Unlock()
+	return c.fakeWatcher.Add(name)
+}
+
+// withoutStat clears the Size, ModTime, Seq and Root of the events so they can be compared without knowing them
+func withoutStat(events ...Event) []Event {
+	cleared := make([]Event, len(events))
+	for i, event := range events {
+		event.Size, event.ModTime, event.Seq, event.Root = 0, time.Time{}, 0, ""
+		cleared[i] = event
+	}
+	return cleared
+}
+
+func TestDebounceEvents(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, PublishEvents: true}, time.Millisecond)
+	require.NoError(t, err)
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	w.debounce(watcher.Event{Op: watcher.Rename, Path: path, OldPath: "testdata/old", FileInfo: info})
+
+	oldPath, _ := filepath.Abs("testdata/old")
+	folder, _ := filepath.Abs("testdata")
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, folder, <-w.FolderChanged)
+	events := []Event{<-w.Events, <-w.Events}
+	assert.ElementsMatch(t, []Event{
+		{Path: path, Op: Rename, OldPath: oldPath},
+		{Path: folder, Op: Write, IsDir: true},
+	}, withoutStat(events...))
+	for _, event := range events {
+		if event.Path == path {
+			assert.Equal(t, info.Size(), event.Size)
+			assert.Equal(t, info.ModTime(), event.ModTime)
+		}
+	}
+}
+
+func TestPublishEvents(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+
+	// without PublishEvents, a consumer which never reads Events doesn't hold up notifications
+	w.notify(w.FileChanged, Event{Path: "/a"})
+	assert.Equal(t, "/a", <-w.FileChanged)
+	w.notify(w.FileChanged, Event{Path: "/b"})
+	assert.Equal(t, "/b", <-w.FileChanged)
+	assert.Empty(t, w.Events)
+	w.Close()
+}
+
+func TestNotifyAny(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, NotifyAny: true, NotifyRemoved: true, ChannelBufferSize: 2}, time.Millisecond)
+	require.NoError(t, err)
+
+	w.notify(w.FileChanged, Event{Path: "/a"})
+	w.notify(w.FolderChanged, Event{Path: "/b", IsDir: true})
+	w.notify(w.FileRemoved, Event{Path: "/c", Op: Remove})
+	assert.Equal(t, "/a", <-w.AnyChanged)
+	assert.Equal(t, "/b", <-w.AnyChanged)
+	assert.Empty(t, w.AnyChanged)
+	assert.Equal(t, "/a", <-w.FileChanged)
+	assert.Equal(t, "/b", <-w.FolderChanged)
+	assert.Equal(t, "/c", <-w.FileRemoved)
+	w.Close()
+}
+
+func TestNotifyRemoved(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+
+	// without NotifyRemoved, a consumer which never reads FileRemoved doesn't hold up notifications
+	w.notify(w.notifyChannel(Event{Path: "/a", Op: Remove}), Event{Path: "/a", Op: Remove})
+	w.notify(w.notifyChannel(Event{Path: "/b", Op: Remove}), Event{Path: "/b", Op: Remove})
+	assert.Empty(t, w.FileRemoved)
+	w.Close()
+}
+
+func TestIgnoreChmod(t *testing.T) {
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, PublishEvents: true, ChannelBufferSize: 2}, time.Millisecond)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Chmod, Path: path, FileInfo: info})
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Contains(t, withoutStat(<-w.Events, <-w.Events), Event{Path: path, Op: Chmod})
+	w.Close()
+
+	w, err = New(Options{RootFolders: []string{"testdata"}, IgnoreChmod: true}, time.Millisecond)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Chmod, Path: path, FileInfo: info})
+	assert.Empty(t, w.PendingFiles())
+	assert.Empty(t, w.PendingFolders())
+	assert.Equal(t, uint64(1), w.Stats().EventsProcessed)
+	w.Close()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Hour, IdleTimeout: time.Second, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	clock.Advance(900 * time.Millisecond)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	clock.Advance(900 * time.Millisecond)
+	assert.Empty(t, w.Idle) // the second event restarted the wait
+
+	clock.Advance(100 * time.Millisecond)
+	<-w.Idle
+	clock.Advance(time.Minute)
+	assert.Empty(t, w.Idle) // only signalled once until the next event
+
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	clock.Advance(time.Second)
+	<-w.Idle
+}
+
+func TestCreateOnly(t *testing.T) {
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	folder, _ := filepath.Abs("testdata")
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, CreateOnly: true}, time.Minute)
+	require.NoError(t, err)
+	defer w.Close()
+	for _, op := range []watcher.Op{watcher.Write, watcher.Chmod, watcher.Remove} {
+		w.debounce(watcher.Event{Op: op, Path: path, FileInfo: info})
+	}
+	assert.Empty(t, w.PendingFiles())
+	assert.Empty(t, w.PendingFolders())
+
+	w.debounce(watcher.Event{Op: watcher.Create, Path: path, FileInfo: info})
+	assert.Equal(t, []string{path}, w.PendingFiles())
+	assert.Equal(t, []string{folder}, w.PendingFolders())
+}
+
+func TestMute(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, ChannelBufferSize: 2}, time.Minute)
+	require.NoError(t, err)
+	defer w.Close()
+	info, err := os.Stat("testdata/dir/file")
+	require.NoError(t, err)
+	muted, _ := filepath.Abs("testdata/dir/file")
+	other, _ := filepath.Abs("testdata/test")
+
+	w.Mute("testdata/dir")
+	w.debounce(watcher.Event{Op: watcher.Write, Path: muted, FileInfo: info})
+	assert.Empty(t, w.PendingFiles())
+	assert.Empty(t, w.PendingFolders())
+	w.debounce(watcher.Event{Op: watcher.Write, Path: other, FileInfo: info})
+	assert.Equal(t, []string{other}, w.PendingFiles())
+	w.fire(Event{Path: muted, Op: Write}) // a pending notification which fires while muted
+	assert.Empty(t, w.FileChanged)
+
+	w.Unmute("testdata/dir")
+	w.fire(Event{Path: muted, Op: Write})
+	assert.Equal(t, muted, <-w.FileChanged)
+}
+
+func TestCollapseToRoot(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, CollapseToRoot: true, FileEventsOnly: true}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFolders: []string{"testdata/dir"}, RootFiles: []string{"testdata/test"}, CollapseToRoot: true}, time.Minute)
+	require.NoError(t, err)
+	defer w.Close()
+	dir, _ := filepath.Abs("testdata/dir")
+	folder, _ := filepath.Abs("testdata")
+	for _, name := range []string{"testdata/dir/file", "testdata/dir/subdir", "testdata/dir/subdir/file", "testdata/test"} {
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		path, _ := filepath.Abs(name)
+		w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	}
+	assert.Empty(t, w.PendingFiles())
+	assert.Equal(t, []string{folder, dir}, w.PendingFolders())
+	w.mutex.Lock()
+	assert.Equal(t, Event{Path: dir, Op: Write, IsDir: true}, w.folderDebounce[dir].event)
+	w.mutex.Unlock()
+
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	deleted, err := New(Options{RootFolders: []string{root}, CollapseToRoot: true}, time.Minute)
+	require.NoError(t, err)
+	defer deleted.Close()
+	require.NoError(t, os.RemoveAll(root)) // a deleted root still reports itself rather than its parent
+	deleted.debounce(watcher.Event{Op: watcher.Remove, Path: file, FileInfo: info})
+	assert.Equal(t, []string{root}, deleted.PendingFolders())
+}
+
+func TestIgnoreEditorTemp(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, IgnoreEditorTemp: true, PublishEvents: true, IncludeHiddenFiles: true}, time.Millisecond)
+	require.NoError(t, err)
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	folder, _ := filepath.Abs("testdata")
+	for _, temp := range []string{"test~", ".test.swp", "4913"} {
+		w.debounce(watcher.Event{Op: watcher.Create, Path: filepath.Join(folder, temp), FileInfo: info})
+	}
+	w.debounce(watcher.Event{Op: watcher.Rename, Path: path, OldPath: filepath.Join(folder, ".test.swp"), FileInfo: info})
+
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, folder, <-w.FolderChanged)
+	assert.ElementsMatch(t, []Event{
+		{Path: path, Op: Write},
+		{Path: folder, Op: Write, IsDir: true},
+	}, withoutStat(<-w.Events, <-w.Events))
+	assert.Empty(t, w.FileChanged)
+	w.Close()
+}
+
+func TestSplitRenames(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, SplitRenames: true, NotifyRemoved: true}, time.Minute)
+	require.NoError(t, err)
+	defer w.Close()
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	oldPath, _ := filepath.Abs("testdata/renamed")
+	w.debounce(watcher.Event{Op: watcher.Rename, Path: path, OldPath: oldPath, FileInfo: info})
+	w.mutex.Lock()
+	assert.Equal(t, Event{Path: oldPath, Op: Remove}, w.fileDebounce[oldPath].event)
+	assert.Equal(t, Event{Path: path, Op: Create}, w.fileDebounce[path].event)
+	w.mutex.Unlock()
+}
+
+func TestDebounceRemoved(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, NotifyRemoved: true}, time.Millisecond)
+	require.NoError(t, err)
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/deleted")
+	w.debounce(watcher.Event{Op: watcher.Remove, Path: path, FileInfo: info})
+
+	folder, _ := filepath.Abs("testdata")
+	assert.Equal(t, path, <-w.FileRemoved)
+	assert.Equal(t, folder, <-w.FolderChanged)
+
+	// a file which vanishes without a remove event isn't reported
+	w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, w.FileRemoved)
+	assert.Empty(t, w.FileChanged)
+	assert.Equal(t, WatcherStats{WatchedFolders: 5, EventsProcessed: 1, Notifications: 2, Dropped: 1}, w.Stats())
+
+	metrics := make(map[string]Metric)
+	for _, metric := range w.MetricsSnapshot() {
+		metrics[metric.Name] = metric
+	}
+	assert.Equal(t, Metric{"gobounce_dropped_total", "Notifications dropped because the path no longer existed or didn't change", CounterMetric, 1}, metrics["gobounce_dropped_total"])
+	assert.Equal(t, 5.0, metrics["gobounce_watched_folders"].Value)
+	assert.Equal(t, GaugeMetric, metrics["gobounce_watched_folders"].Type)
+	assert.Equal(t, 0.0, metrics["gobounce_running"].Value)
+	assert.Len(t, metrics, 13)
+}
+
+func TestDropErrors(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, ChannelBufferSize: 1, DropErrors: true}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	first, second := errors.New("first"), errors.New("second")
+	w.sendError(first)
+	w.sendError(second) // nobody is reading, so it doesn't wait
+	assert.Equal(t, first, <-w.Error)
+	assert.Empty(t, w.Error)
+	assert.Equal(t, uint64(1), w.Stats().DroppedErrors)
+}
+
+func TestStatError(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+
+	path, _ := filepath.Abs("testdata/test/file") // not a directory, so stat fails with something other than not exist
+	w.fire(Event{Path: path, Op: Write})
+	err = <-w.Error
+	var watchErr *WatchError
+	require.ErrorAs(t, err, &watchErr)
+	assert.Equal(t, "stat", watchErr.Op)
+	assert.Equal(t, path, watchErr.Path)
+	assert.Empty(t, w.FileChanged)
+	assert.Equal(t, WatcherStats{WatchedFolders: 5}, w.Stats())
+	w.Close()
+}
+
+func TestIncludePatterns(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, IncludePatterns: []string{"["}}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, IncludePatterns: []string{"*.go", "test?"}}, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, w.isIncludedFile("testdata/test2"))
+	assert.True(t, w.isIncludedFile("/some/dir/main.go"))
+	assert.False(t, w.isIncludedFile("testdata/test"))
+	assert.False(t, w.isIncludedFile("/some/dir/main.go.swp"))
+
+	w, err = New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, w.isIncludedFile("testdata/test"))
+}
+
+func TestMixedSeparators(t *testing.T) {
+	sep := string(filepath.Separator)
+	assert.Equal(t, []string{sep + "dir" + sep + "exclude" + sep, sep + "dir" + sep + "exclude" + sep, sep + "a" + sep + "b" + sep}, prepareFolders([]string{`dir/exclude`, `dir\exclude`, `\a/b/`}))
+
+	for _, exclusion := range []string{`dir/exclude`, `dir\exclude`} {
+		w, err := New(Options{RootFolders: []string{"testdata"}, FolderExclusions: []string{exclusion}, ExcludePrefixes: []string{`testdata\dir/subdir`}}, time.Millisecond)
+		require.NoError(t, err)
+		assert.True(t, w.isExcludedFolder(filepath.Join("testdata", "dir", "exclude", "othersubdir")), exclusion)
+		assert.True(t, w.isExcludedFolder(filepath.Join("testdata", "dir", "subdir")))
+		assert.False(t, w.isExcludedFolder(filepath.Join("testdata", "dir")))
+		w.Close()
+	}
+}
+
+func TestAnchoredFolderExclusions(t *testing.T) {
+	sep := string(filepath.Separator)
+	assert.Equal(t, []string{"." + sep + "build" + sep, "." + sep + "a" + sep + "b" + sep}, prepareFolders([]string{"./build/", `.\a/b`}))
+
+	root := t.TempDir()
+	for _, folder := range []string{"build/out", "src/build", "docs/build"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, folder), 0755))
+	}
+	w, err := New(Options{RootFolders: []string{root}, FolderExclusions: []string{"./build", "./docs/build"}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.True(t, w.isExcludedFolder(filepath.Join(root, "build")))
+	assert.True(t, w.isExcludedFolder(filepath.Join(root, "build", "out")))
+	assert.True(t, w.isExcludedFolder(filepath.Join(root, "docs", "build")))
+	assert.False(t, w.isExcludedFolder(filepath.Join(root, "src", "build"))) // nested too deep to match
+	assert.False(t, w.isExcludedFolder(filepath.Join(root, "builder")))
+	assert.False(t, w.isExcludedFolder(root))
+	assert.Equal(t, []string{root, filepath.Join(root, "docs"), filepath.Join(root, "src"), filepath.Join(root, "src", "build")}, w.InitialFolders())
+}
+
+func TestExcludePatterns(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, ExcludePatterns: []string{"["}}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, IncludePatterns: []string{"test*"}, ExcludePatterns: []string{"*2", "*.log"}}, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, w.isIncludedFile("testdata/test"))
+	assert.False(t, w.isIncludedFile("testdata/test2"))
+	assert.False(t, w.isIncludedFile("/some/dir/test.log"))
+
+	test2, _ := filepath.Abs("testdata/test2")
+	_, ok := w.underlying().WatchedFiles()[test2]
+	assert.False(t, ok)
+}
+
+func TestFilterHookDoesntLock(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "debug.log"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "main.go"), nil, 0644))
+	w, err := New(Options{RootFolders: []string{root}, ExcludePatterns: []string{"*.log"}}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	polled := w.LastPollTime()
+	w.mutex.Lock() // the hook runs for every file on every poll, so it mustn't wait for the mutex
+	err = w.underlying().Add(root)
+	w.mutex.Unlock()
+	require.NoError(t, err)
+	assert.True(t, w.LastPollTime().After(polled))
+	files := w.underlying().WatchedFiles()
+	assert.Contains(t, files, filepath.Join(root, "main.go"))
+	assert.NotContains(t, files, filepath.Join(root, "debug.log"))
+}
+
+func TestWatchExtensions(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.json", "b.JSON", "c.jpg", "d"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), nil, 0644))
+	}
+	w, err := New(Options{RootFolders: []string{root}, WatchExtensions: []string{"json", ".yaml"}, CaseInsensitive: true}, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, w.isIncludedFile("/some/dir/config.yaml"))
+	assert.False(t, w.isIncludedFile("/some/dir/config.yml"))
+
+	files := w.underlying().WatchedFiles()
+	assert.Contains(t, files, filepath.Join(root, "a.json"))
+	assert.Contains(t, files, filepath.Join(root, "b.JSON"))
+	assert.NotContains(t, files, filepath.Join(root, "c.jpg"))
+	assert.NotContains(t, files, filepath.Join(root, "d"))
+}
+
+func TestWatchignore(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"node_modules", "src", filepath.Join("src", "build"), filepath.Join("src", "vendor")} {
+		require.NoError(t, os.Mkdir(filepath.Join(root, dir), 0755))
+	}
+	ignore := "# generated\nnode_modules\n\n*.o\nsrc/build/\n"
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".watchignore"), []byte(ignore), 0644))
+
+	w, err := New(Options{RootFolders: []string{root}, Watchignore: true}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.mutex.Lock()
+	assert.Equal(t, map[string]bool{root: true, filepath.Join(root, "src"): true, filepath.Join(root, "src", "vendor"): true}, w.folders)
+	w.mutex.Unlock()
+	assert.True(t, w.IsExcluded(filepath.Join(root, "src", "main.o")))
+	assert.True(t, w.IsExcluded(filepath.Join(root, "node_modules", "pkg", "index.js")))
+	assert.True(t, w.IsExcluded(filepath.Join(root, "src", "build", "out")))
+	assert.False(t, w.IsExcluded(filepath.Join(root, "src", "main.go")))
+	assert.False(t, w.IsExcluded(filepath.Join(root, "build", "out")))
+	assert.Contains(t, w.underlying().WatchedFiles(), filepath.Join(root, ".watchignore"))
+	assert.Empty(t, w.existingFiles()) // only watched to reload the patterns
+	planned, err := PlanWatch(Options{RootFolders: []string{root}, Watchignore: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{root, filepath.Join(root, "src"), filepath.Join(root, "src", "vendor")}, planned)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".watchignore"), []byte("vendor\n"), 0644))
+	info, err := os.Stat(filepath.Join(root, ".watchignore"))
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: filepath.Join(root, ".watchignore"), FileInfo: info})
+	assert.False(t, w.IsExcluded(filepath.Join(root, "src", "main.o")))
+	assert.True(t, w.IsExcluded(filepath.Join(root, "src", "vendor", "lib.go")))
+	assert.Empty(t, w.PendingFiles())
+
+	require.NoError(t, w.SetIncludeHidden(true)) // still not notified when hidden files are
+	w.debounce(watcher.Event{Op: watcher.Write, Path: filepath.Join(root, ".watchignore"), FileInfo: info})
+	assert.Empty(t, w.PendingFiles())
+	assert.Empty(t, w.existingFiles())
+}
+
+func TestFilter(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "skip"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "keep"), 0755))
+	small, large := filepath.Join(root, "small"), filepath.Join(root, "large")
+	require.NoError(t, os.WriteFile(small, []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(large, []byte("too large"), 0644))
+	filter := func(path string, info os.FileInfo) bool {
+		if info.IsDir() {
+			return info.Name() != "skip"
+		}
+		return info.Size() < 5
+	}
+
+	w, err := New(Options{RootFolders: []string{root}, Filter: filter}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.mutex.Lock()
+	assert.Equal(t, map[string]bool{root: true, filepath.Join(root, "keep"): true}, w.folders)
+	w.mutex.Unlock()
+	files := w.underlying().WatchedFiles()
+	assert.Contains(t, files, small)
+	assert.NotContains(t, files, large)
+
+	info, err := os.Stat(large)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: large, FileInfo: info})
+	assert.Empty(t, w.PendingFiles())
+	info, err = os.Stat(small)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: small, FileInfo: info})
+	assert.Equal(t, []string{small}, w.PendingFiles())
+}
+
+func TestFolderEventsOnly(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, FolderEventsOnly: true, DebounceDuration: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	folder, _ := filepath.Abs("testdata")
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	assert.Empty(t, w.PendingFiles())
+	assert.Equal(t, []string{folder}, w.PendingFolders())
+}
+
+func TestFileEventsOnly(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, FolderEventsOnly: true, FileEventsOnly: true}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, FileEventsOnly: true, DebounceDuration: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	info, err = os.Stat("testdata/dir")
+	require.NoError(t, err)
+	dir, _ := filepath.Abs("testdata/dir")
+	w.debounce(watcher.Event{Op: watcher.Write, Path: dir, FileInfo: info})
+	assert.Equal(t, []string{path}, w.PendingFiles())
+	assert.Empty(t, w.PendingFolders())
+}
+
+func TestIgnoreTransientFiles(t *testing.T) {
+	root := t.TempDir()
+	temp, kept := filepath.Join(root, "temp"), filepath.Join(root, "kept")
+	require.NoError(t, os.WriteFile(temp, nil, 0644))
+	info, err := os.Stat(temp)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(temp))
+
+	w, err := New(Options{RootFolders: []string{root}, IgnoreTransientFiles: true, NotifyRemoved: true, DebounceDuration: 20 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.debounce(watcher.Event{Op: watcher.Create, Path: temp, FileInfo: info})
+	w.debounce(watcher.Event{Op: watcher.Remove, Path: temp, FileInfo: info})
+	require.Eventually(t, func() bool { return w.Stats().Dropped == 2 }, time.Second, time.Millisecond)
+	assert.Empty(t, w.FileRemoved)
+	assert.Empty(t, w.FolderChanged)
+
+	require.NoError(t, os.WriteFile(kept, nil, 0644)) // a surviving file still notifies for its folder
+	w.debounce(watcher.Event{Op: watcher.Create, Path: temp, FileInfo: info})
+	w.debounce(watcher.Event{Op: watcher.Create, Path: kept, FileInfo: info})
+	w.debounce(watcher.Event{Op: watcher.Remove, Path: temp, FileInfo: info})
+	assert.Equal(t, kept, <-w.FileChanged)
+	assert.Equal(t, root, <-w.FolderChanged)
+}
+
+func TestCallbacks(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+
+	files := make(chan string, 1)
+	folders := make(chan string, 1)
+	w.OnFileChanged(func(path string) { files <- path })
+	w.OnFolderChanged(func(path string) { folders <- path })
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	folder, _ := filepath.Abs("testdata")
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+
+	assert.Equal(t, path, <-files)
+	assert.Equal(t, folder, <-folders)
+	assert.Empty(t, w.FileChanged)
+	assert.Empty(t, w.Events)
+}
+
+func TestDebounceMode(t *testing.T) {
+	path, _ := filepath.Abs("testdata/test")
+	tests := []struct {
+		name     string
+		mode     DebounceMode
+		events   int
+		leading  bool
+		trailing int
+	}{
+		{"trailing edge", TrailingEdge, 3, false, 1},
+		{"leading edge", LeadingEdge, 3, true, 0},
+		{"both with a single event", Both, 1, true, 0},
+		{"both", Both, 3, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := New(Options{RootFolders: []string{"testdata"}, DebounceMode: tt.mode, DebounceDuration: 20 * time.Millisecond}, time.Millisecond)
+			require.NoError(t, err)
+
+			w.mutex.Lock()
+			for i := 0; i < tt.events; i++ {
+				w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+			}
+			w.mutex.Unlock()
+			if tt.leading {
+				select {
+				case got := <-w.FileChanged:
+					assert.Equal(t, path, got)
+				case <-time.After(10 * time.Millisecond):
+					t.Fatal("expected a leading edge notification before the debounce duration")
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			assert.Len(t, w.FileChanged, tt.trailing)
+			w.Close()
+		})
+	}
+}
+
+func TestDebounceByPattern(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, DebounceByPattern: map[string]time.Duration{"*.go": time.Millisecond}}, time.Millisecond)
+	assert.Error(t, err)
+	_, err = New(Options{RootFolders: []string{"testdata"}, DebounceByPattern: map[string]time.Duration{"[": time.Second}}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{
+		RootFolders:       []string{"testdata"},
+		DebounceDuration:  time.Second,
+		DebounceByPattern: map[string]time.Duration{"*.go": 10 * time.Millisecond, "*.bin": time.Minute, "big*": time.Hour},
+	}, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Millisecond, w.debounceFor(Event{Path: "/a/main.go"}))
+	assert.Equal(t, time.Minute, w.debounceFor(Event{Path: "/a/asset.bin"}))
+	assert.Equal(t, time.Hour, w.debounceFor(Event{Path: "/a/big.bin"}))
+	assert.Equal(t, time.Second, w.debounceFor(Event{Path: "/a/README"}))
+	assert.Equal(t, time.Second, w.debounceFor(Event{Path: "/a/pkg.go", IsDir: true}))
+}
+
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	at     time.Time
+	active bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), active: true}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward, firing any timers which are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	for _, timer := range c.timers {
+		if timer.active && !timer.at.After(c.now) {
+			timer.active = false
+			select {
+			case timer.c <- c.now:
+			default: // still holds an earlier firing, which wakes the receiver just the same
+			}
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.at, t.active = t.clock.now.Add(d), true
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+// fakeWatcher is a Watcher which only reports the events sent to it
+type fakeWatcher struct {
+	mutex    sync.Mutex
+	added    map[string]bool
+	events   chan watcher.Event
+	errors   chan error
+	started  chan struct{}
+	closed   chan struct{}
+	closeErr error // returned by Close
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{added: make(map[string]bool), events: make(chan watcher.Event), errors: make(chan error), started: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (f *fakeWatcher) Add(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.added[name] = true
+	return nil
+}
+
+func (f *fakeWatcher) Remove(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.added, name)
+	return nil
+}
+
+func (f *fakeWatcher) Start(time.Duration) error {
+	close(f.started)
+	<-f.closed
+	return nil
+}
+
+func (f *fakeWatcher) Close() error                         { close(f.closed); return f.closeErr }
+func (f *fakeWatcher) Wait()                                { <-f.started }
+func (f *fakeWatcher) WatchedFiles() map[string]os.FileInfo { return nil }
+func (f *fakeWatcher) Events() <-chan watcher.Event         { return f.events }
+func (f *fakeWatcher) Errors() <-chan error                 { return f.errors }
+func (f *fakeWatcher) Closed() <-chan struct{}              { return f.closed }
+
+func TestNewWatcher(t *testing.T) {
+	fake := newFakeWatcher()
+	dir, _ := filepath.Abs("testdata/dir")
+	w, err := New(Options{RootFolders: []string{dir}, NewWatcher: func() (Watcher, error) { return fake, nil }}, time.Millisecond)
+	require.NoError(t, err)
+	fake.mutex.Lock()
+	assert.True(t, fake.added[dir])
+	assert.True(t, fake.added[filepath.Join(dir, "subdir")])
+	fake.mutex.Unlock()
+	go w.Start()
+	fake.Wait()
+
+	path := filepath.Join(dir, "file")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	fake.events <- watcher.Event{Op: watcher.Write, Path: path, FileInfo: info}
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, dir, <-w.FolderChanged)
+	w.Close()
+	<-fake.Closed()
+
+	_, err = New(Options{RootFolders: []string{"testdata"}, NewWatcher: func() (Watcher, error) { return nil, errors.New("unavailable") }}, time.Millisecond)
+	assert.EqualError(t, err, "unavailable")
+}
+
+func TestClock(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Second, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+
+	path, _ := filepath.Abs("testdata/test")
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+	w.mutex.Unlock()
+	clock.Advance(900 * time.Millisecond)
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+	w.mutex.Unlock()
+	clock.Advance(900 * time.Millisecond)
+	w.mutex.Lock()
+	assert.Contains(t, w.fileDebounce, path) // the timer was reset, so it hasn't fired yet
+	w.mutex.Unlock()
+
+	clock.Advance(100 * time.Millisecond)
+	assert.Equal(t, path, <-w.FileChanged)
+	w.Close()
+}
+
+func TestSharedDebounceTimer(t *testing.T) {
+	root := t.TempDir()
+	a, b, c := filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "c")
+	for _, path := range []string{a, b, c} {
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+	}
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{root}, DebounceDuration: time.Second, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: a, Op: Write})
+	w.mutex.Unlock()
+	clock.Advance(500 * time.Millisecond)
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: b, Op: Write})
+	w.debounceItem(w.fileDebounce, Event{Path: c, Op: Write})
+	w.debounceItem(w.fileDebounce, Event{Path: c, Op: Write}) // resetting a timer doesn't add another
+	w.mutex.Unlock()
+	clock.mutex.Lock()
+	assert.Len(t, clock.timers, 1)
+	clock.mutex.Unlock()
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Equal(t, a, <-w.FileChanged)
+	w.mutex.Lock()
+	assert.Len(t, w.fileDebounce, 2)
+	assert.Len(t, w.timers, 2)
+	w.mutex.Unlock()
+
+	clock.Advance(500 * time.Millisecond)
+	assert.ElementsMatch(t, []string{b, c}, []string{<-w.FileChanged, <-w.FileChanged})
+	w.mutex.Lock()
+	assert.Empty(t, w.timers)
+	w.mutex.Unlock()
+}
+
+func TestBoundedSettlers(t *testing.T) {
+	root := t.TempDir()
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{root}, DebounceDuration: time.Second, MaxConcurrency: 2, ChannelBufferSize: 1, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	w.mutex.Lock()
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(root, fmt.Sprintf("file%d", i))
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+	}
+	w.mutex.Unlock()
+
+	clock.Advance(time.Second)
+	require.Eventually(t, func() bool { // one notification is buffered while the two settlers wait for the consumer
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		return len(w.settling) == 47
+	}, time.Second, time.Millisecond)
+	w.mutex.Lock()
+	assert.Equal(t, 2, w.settlers)
+	w.mutex.Unlock()
+
+	for i := 0; i < 50; i++ {
+		<-w.FileChanged
+	}
+	require.Eventually(t, func() bool {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		return w.settlers == 0 && len(w.settling) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestPendingPaths(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Empty(t, w.PendingFiles())
+
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: "/b"})
+	w.debounceItem(w.fileDebounce, Event{Path: "/a"})
+	w.debounceItem(w.folderDebounce, Event{Path: "/dir", IsDir: true})
+	w.mutex.Unlock()
+	files := w.PendingFiles()
+	assert.Equal(t, []string{"/a", "/b"}, files)
+	assert.Equal(t, []string{"/dir"}, w.PendingFolders())
+
+	files[0] = "/changed"
+	assert.Equal(t, []string{"/a", "/b"}, w.PendingFiles())
+}
+
+func TestStabilityDelay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "copying")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	w, err := New(Options{RootFolders: []string{filepath.Dir(path)}, DebounceDuration: 20 * time.Millisecond, StabilityDelay: 50 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	start := time.Now()
+	copied := make(chan struct{})
+	go func() { // keeps growing the file well past the debounce duration
+		defer close(copied)
+		file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		defer file.Close()
+		for time.Since(start) < 150*time.Millisecond {
+			file.Write([]byte("data"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	w.mutex.Lock()
+	w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+	w.mutex.Unlock()
+
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	<-copied
+}
+
+func TestSeq(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, PublishEvents: true, ChannelBufferSize: 3}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for _, name := range []string{"testdata/test", "testdata/test2", "testdata/dir/file"} {
+		path, _ := filepath.Abs(name)
+		w.fire(Event{Path: path, Op: Write})
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, []uint64{(<-w.Events).Seq, (<-w.Events).Seq, (<-w.Events).Seq})
+}
+
+func TestMaxNotificationsPerSecond(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{"testdata"}, MaxNotificationsPerSecond: 2, DropThrottled: true, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	event := Event{Path: "file", Op: Write}
+	assert.True(t, w.throttle(event))
+	assert.True(t, w.throttle(event))
+	assert.False(t, w.throttle(event))
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, w.throttle(event))
+	assert.False(t, w.throttle(event))
+	assert.Equal(t, uint64(2), w.Stats().Throttled)
+
+	w.mutex.Lock()
+	w.options.DropThrottled = false
+	w.mutex.Unlock()
+	throttled := make(chan bool)
+	go func() { throttled <- w.throttle(event) }()
+	require.Eventually(t, func() bool { // waiting for a token to be refilled
+		clock.mutex.Lock()
+		defer clock.mutex.Unlock()
+		return len(clock.timers) == 1
+	}, time.Second, time.Millisecond)
+	select {
+	case <-throttled:
+		t.Fatal("expected the notification to wait")
+	default:
+	}
+	clock.Advance(500 * time.Millisecond)
+	assert.True(t, <-throttled)
+	assert.Equal(t, uint64(2), w.Stats().Throttled)
+}
+
+func TestThrottleLeadingEdge(t *testing.T) {
+	root := t.TempDir()
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{root}, DebounceMode: LeadingEdge, MaxNotificationsPerSecond: 1, DropThrottled: true, DebounceDuration: time.Minute, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+		w.mutex.Lock()
+		w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+		w.mutex.Unlock()
+	}
+	require.Eventually(t, func() bool { return w.Stats().Throttled == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), w.Stats().Notifications)
+	assert.Len(t, w.FileChanged, 1)
+}
+
+func TestSkipUnchangedContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "formatted.go")
+	require.NoError(t, os.WriteFile(path, []byte("package main"), 0644))
+	w, err := New(Options{RootFolders: []string{filepath.Dir(path)}, SkipUnchangedContent: true, DebounceDuration: time.Millisecond * 2}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	unchanged, hash := w.isUnchangedContent(Event{Path: path, Op: Write})
+	assert.False(t, unchanged) // the previous content isn't known yet
+	assert.NotNil(t, hash)
+	unchanged, _ = w.isUnchangedContent(Event{Path: path, Op: Write})
+	assert.False(t, unchanged) // only recorded once notified
+	w.publish(Event{Path: path, Op: Write})
+	assert.Equal(t, path, <-w.FileChanged)
+	unchanged, _ = w.isUnchangedContent(Event{Path: path, Op: Write})
+	assert.True(t, unchanged)
+	unchanged, _ = w.isUnchangedContent(Event{Path: path, Op: Chmod})
+	assert.True(t, unchanged)
+	unchanged, _ = w.isUnchangedContent(Event{Path: path, Op: Create})
+	assert.False(t, unchanged)
+	w.publish(Event{Path: path, Op: Write})
+	assert.Equal(t, uint64(1), w.Stats().Dropped)
+
+	// a change held while paused is still notified on Resume
+	require.NoError(t, os.WriteFile(path, []byte("package main\n"), 0644))
+	w.Pause()
+	w.publish(Event{Path: path, Op: Write})
+	w.Resume()
+	assert.Equal(t, path, <-w.FileChanged)
+	unchanged, _ = w.isUnchangedContent(Event{Path: path, Op: Write})
+	assert.True(t, unchanged)
+	assert.Equal(t, uint64(1), w.Stats().Dropped)
+
+	require.NoError(t, os.Remove(path))
+	unchanged, hash = w.isUnchangedContent(Event{Path: path, Op: Remove})
+	assert.False(t, unchanged)
+	assert.Nil(t, hash)
+	w.mutex.Lock()
+	assert.NotContains(t, w.contentHashes, path)
+	w.mutex.Unlock()
+}
+
+func TestDedupeWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	w, err := New(Options{RootFolders: []string{"testdata"}, DedupeWindow: time.Second, ChannelBufferSize: 4, Clock: clock}, time.Millisecond)
+	require.NoError(t, err)
+	defer w.Close()
+
+	path, _ := filepath.Abs("testdata/test")
+	w.fire(Event{Path: path, Op: Write})
+	w.fire(Event{Path: path, Op: Write})  // suppressed
+	w.fire(Event{Path: path, Op: Create}) // a different operation isn't a duplicate
+	clock.Advance(time.Second)
+	w.fire(Event{Path: path, Op: Write})
+	assert.Len(t, w.FileChanged, 3)
+	assert.Equal(t, uint64(1), w.Stats().Deduplicated)
+	assert.Equal(t, uint64(3), w.Stats().Notifications)
+}
+
+func TestMaxDebounceDuration(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: time.Second, MaxDebounceDuration: time.Millisecond}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, DebounceDuration: 20 * time.Millisecond, MaxDebounceDuration: 50 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	start := time.Now()
+	for time.Since(start) < 150*time.Millisecond && len(w.FileChanged) == 0 {
+		w.mutex.Lock()
+		w.debounceItem(w.fileDebounce, Event{Path: path, Op: Write})
+		w.mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Less(t, int64(time.Since(start)), int64(150*time.Millisecond))
+	w.Close()
+}
+
+func TestCoalesceFolders(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, CoalesceFolders: true, DebounceDuration: time.Minute}, time.Millisecond)
+	require.NoError(t, err)
+
+	w.debounceItem(w.folderDebounce, Event{Path: "/a", IsDir: true})
+	w.debounceItem(w.folderDebounce, Event{Path: "/a/b", IsDir: true})
+	w.debounceItem(w.folderDebounce, Event{Path: "/a", IsDir: true})
+	w.debounceItem(w.folderDebounce, Event{Path: "/a/bc", IsDir: true})
+	w.debounceItem(w.folderDebounce, Event{Path: "/a/b", IsDir: true})
+
+	assert.Len(t, w.folderDebounce, 2)
+	assert.Contains(t, w.folderDebounce, "/a/b")
+	assert.Contains(t, w.folderDebounce, "/a/bc")
+	w.Close()
+}
+
+func TestBatchChanged(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, BatchWindow: 10 * time.Millisecond}, time.Millisecond)
+	require.NoError(t, err)
+
+	w.mutex.Lock()
+	w.addToBatch("/a")
+	w.addToBatch("/b")
+	w.addToBatch("/a")
+	w.mutex.Unlock()
+	assert.Equal(t, []string{"/a", "/b"}, <-w.BatchChanged)
+
+	w.mutex.Lock()
+	w.addToBatch("/c")
+	w.mutex.Unlock()
+	assert.Equal(t, []string{"/c"}, <-w.BatchChanged)
+	w.Close()
+}
+
+func TestGroupByFolder(t *testing.T) {
+	_, err := New(Options{RootFolders: []string{"testdata"}, GroupByFolder: true}, time.Millisecond)
+	assert.EqualError(t, err, "GroupByFolder requires a BatchWindow")
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, BatchWindow: 10 * time.Millisecond, GroupByFolder: true}, time.Millisecond)
+	require.NoError(t, err)
+	w.mutex.Lock()
+	w.addToBatch("/a/y")
+	w.addToBatch("/b/z")
+	w.addToBatch("/a/x")
+	w.mutex.Unlock()
+	assert.Equal(t, map[string][]string{"/a": {"/a/y", "/a/x"}, "/b": {"/b/z"}}, <-w.BatchByFolder)
+	assert.Empty(t, w.BatchChanged)
+
+	w.mutex.Lock()
+	w.addToBatch("/a/x")
+	w.mutex.Unlock()
+	require.NoError(t, w.FlushAndClose())
+	assert.Equal(t, map[string][]string{"/a": {"/a/x"}}, <-w.BatchByFolder)
+}
+
+func TestDropOnFull(t *testing.T) {
+	w, err := New(Options{RootFolders: []string{"testdata"}, DropOnFull: true, ChannelBufferSize: 1, PublishEvents: true}, time.Millisecond)
+	require.NoError(t, err)
+
+	w.notify(w.FileChanged, Event{Path: "/a"})
+	w.notify(w.FileChanged, Event{Path: "/b"})
+	assert.Equal(t, "/a", <-w.FileChanged)
+	assert.Equal(t, Event{Path: "/a"}, <-w.Events)
+	assert.Equal(t, uint64(1), w.Stats().DroppedFull)
+	assert.Equal(t, uint64(1), w.Stats().DroppedEvents)
+
+	// a full Events channel which nobody subscribed to isn't counted
+	w, err = New(Options{RootFolders: []string{"testdata"}, DropOnFull: true, ChannelBufferSize: 1}, time.Millisecond)
+	require.NoError(t, err)
+	w.notify(w.FileChanged, Event{Path: "/a"})
+	w.notify(w.FileChanged, Event{Path: "/b"})
+	assert.Equal(t, WatcherStats{WatchedFolders: 5, DroppedFull: 1}, w.Stats())
+}
+
+func TestRootFiles(t *testing.T) {
+	_, err := New(Options{RootFiles: []string{"testdata/dir"}}, time.Millisecond)
+	assert.Error(t, err)
+	_, err = New(Options{RootFiles: []string{"testdata/bogus"}}, time.Millisecond)
+	assert.Error(t, err)
+
+	w, err := New(Options{RootFiles: []string{"testdata/test"}}, time.Millisecond)
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	assert.Len(t, w.underlying().WatchedFiles(), 1)
+	assert.Contains(t, w.underlying().WatchedFiles(), path)
+
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Empty(t, w.folderDebounce)
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	options := Options{
+		RootFolders:             []string{"testdata"},
+		FolderExclusions:        []string{"Temp"},
+		FolderExclusionPatterns: []string{"/Build$"},
+		IncludePatterns:         []string{"*.GO"},
+		ExcludePatterns:         []string{"Skip*"},
+	}
+	w, err := New(options, time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, w.isExcludedFolder("/a/temp"))
+	assert.False(t, w.isExcludedFolder("/a/build"))
+	assert.False(t, w.isIncludedFile("/a/main.go"))
+
+	options.CaseInsensitive = true
+	w, err = New(options, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, w.isExcludedFolder("/a/temp"))
+	assert.True(t, w.isExcludedFolder("/a/TEMP/b"))
+	assert.True(t, w.isExcludedFolder("/a/build"))
+	assert.True(t, w.isIncludedFile("/a/main.go"))
+	assert.False(t, w.isIncludedFile("/a/skip.go"))
+}
+
+func TestHiddenFileEvents(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".DS_Store"), nil, 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, ".git"), 0755))
+	info, err := os.Stat(filepath.Join(root, ".DS_Store"))
+	require.NoError(t, err)
+	dirInfo, err := os.Stat(filepath.Join(root, ".git"))
+	require.NoError(t, err)
+
+	w, err := New(Options{RootFolders: []string{root}, IncludeHiddenFolders: true}, time.Millisecond)
+	require.NoError(t, err)
+	assert.NotContains(t, w.underlying().WatchedFiles(), filepath.Join(root, ".DS_Store"))
+	w.debounce(watcher.Event{Op: watcher.Write, Path: filepath.Join(root, ".DS_Store"), FileInfo: info})
+	assert.Empty(t, w.fileDebounce)
+
+	w, err = New(Options{RootFolders: []string{root}, IncludeHiddenFiles: true}, time.Minute)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: filepath.Join(root, ".git"), FileInfo: dirInfo})
+	assert.Empty(t, w.folderDebounce)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: filepath.Join(root, ".DS_Store"), FileInfo: info})
+	assert.Len(t, w.fileDebounce, 1)
+	w.Close()
+}
+
+func TestRelativePaths(t *testing.T) {
+	w := &Filewatcher{options: Options{RootFolders: []string{"testdata", "testdata/dir"}, RelativePaths: true}}
+	root, _ := filepath.Abs("testdata")
+	assert.Equal(t, "test", w.publishedPath(filepath.Join(root, "test")))
+	assert.Equal(t, filepath.Join("subdir", "file"), w.publishedPath(filepath.Join(root, "dir", "subdir", "file")))
+	assert.Equal(t, ".", w.publishedPath(root))
+	assert.Equal(t, "/elsewhere/file", w.publishedPath("/elsewhere/file"))
+
+	w.options.RelativePaths = false
+	assert.Equal(t, filepath.Join(root, "test"), w.publishedPath(filepath.Join(root, "test")))
+}
+
+func TestForwardSlashes(t *testing.T) {
+	w := &Filewatcher{options: Options{RootFolders: []string{"testdata"}, RelativePaths: true, ForwardSlashes: true}}
+	root, _ := filepath.Abs("testdata")
+	assert.Equal(t, "dir/subdir/file", w.publishedPath(filepath.Join(root, "dir", "subdir", "file")))
+	assert.Equal(t, filepath.ToSlash(root)+"/dir", (&Filewatcher{options: Options{ForwardSlashes: true}}).publishedPath(filepath.Join(root, "dir")))
+}
+
+func TestPause(t *testing.T) {
+	info, err := os.Stat("testdata/test")
+	require.NoError(t, err)
+	path, _ := filepath.Abs("testdata/test")
+	root, _ := filepath.Abs("testdata")
+
+	w, err := New(Options{RootFolders: []string{"testdata"}, NotifyOnResume: true}, time.Millisecond)
+	require.NoError(t, err)
+	w.Pause()
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	assert.Empty(t, w.fileDebounce)
+	w.Resume()
+	assert.Equal(t, root, <-w.FolderChanged)
+	assert.Empty(t, w.FileChanged)
+	w.Close()
+
+	w, err = New(Options{RootFolders: []string{"testdata"}, BufferWhilePaused: true, NotifyOnResume: true}, time.Millisecond)
+	require.NoError(t, err)
+	w.Pause()
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	assert.Len(t, w.held, 2)
+	w.Resume()
+	assert.Equal(t, path, <-w.FileChanged)
+	assert.Equal(t, root, <-w.FolderChanged)
+	w.Close()
+
+	// timers firing while paused are held until Resume
+	w, err = New(Options{RootFolders: []string{"testdata"}}, time.Millisecond)
+	require.NoError(t, err)
+	w.debounce(watcher.Event{Op: watcher.Write, Path: path, FileInfo: info})
+	w.Pause()
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, w.FileChanged)
+	w.Resume()
+	assert.Equal(t, path, <-w.FileChanged)
+	w.Close()
+}
+
+func TestMergeEvents(t *testing.T) {
+	assert.Equal(t, Create, mergeEvents(Event{Op: Create}, Event{Op: Write}).Op)
+	assert.Equal(t, Remove, mergeEvents(Event{Op: Create}, Event{Op: Remove}).Op)
+	assert.Equal(t, Write, mergeEvents(Event{Op: Chmod}, Event{Op: Write}).Op)
+}